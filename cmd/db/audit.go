@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	auditPath        = "/admin/audit"
+	auditFileName    = "audit.jsonl"
+	auditRotatedGlob = "audit-*.jsonl"
+	// auditQueryLimit is the default and the maximum number of records
+	// returned by a query.
+	auditQueryLimit = 1000
+)
+
+var (
+	errAuditClosed   = errors.New("audit log is closed")
+	errAuditDisabled = errors.New("audit log is not enabled")
+	errAuditWrite    = errors.New("failed to write the audit log")
+)
+
+const (
+	auditPending = "pending"
+	auditOK      = "ok"
+	auditFailed  = "failed"
+	auditDenied  = "denied"
+)
+
+// AuditRecord describes a mutation or a denied request. A mutation is
+// recorded twice under the same ID: as pending before it is applied and with
+// its result after. A pending record without a result is a mutation
+// interrupted by a crash, which may or may not have been applied.
+type AuditRecord struct {
+	ID        string    `json:"id,omitempty"`
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client,omitempty"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Namespace string    `json:"namespace,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	ValueSize int       `json:"value_size"`
+	Status    int       `json:"status,omitempty"`
+	Result    string    `json:"result"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// auditLog appends records to audit.jsonl in its directory. The file is
+// rotated to audit-<time>.jsonl when it grows over maxSize bytes, and only
+// the newest maxFiles rotated files are kept.
+type auditLog struct {
+	dir      string
+	maxSize  int64
+	maxFiles int
+	// idPrefix tells the IDs of records written since different starts apart.
+	idPrefix string
+	lastID   atomic.Uint64
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+func openAuditLog(dir string, maxSize int64, maxFiles int) (*auditLog, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	l := &auditLog{dir: dir, maxSize: maxSize, maxFiles: maxFiles, idPrefix: strconv.FormatInt(time.Now().UnixNano(), 36)}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(filepath.Join(l.dir, auditFileName), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+func (l *auditLog) write(r AuditRecord) error {
+	return l.writeAll([]AuditRecord{r}, false)
+}
+
+// writeAll appends the records and, if sync is set, waits for them to reach
+// the disk.
+func (l *auditLog) writeAll(records []AuditRecord, sync bool) error {
+	lines := make([][]byte, len(records))
+	for i, r := range records {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		lines[i] = append(data, '\n')
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return errAuditClosed
+	}
+	for _, data := range lines {
+		if l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+			if err := l.rotate(); err != nil {
+				return err
+			}
+		}
+		n, err := l.file.Write(data)
+		l.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	if sync {
+		return l.file.Sync()
+	}
+	return nil
+}
+
+func (l *auditLog) nextID() string {
+	return l.idPrefix + "-" + strconv.FormatUint(l.lastID.Add(1), 10)
+}
+
+// rotate renames the current file and removes the rotated files over the
+// limit. Names of rotated files sort by time.
+func (l *auditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	rotated := fmt.Sprintf("audit-%s.jsonl", time.Now().UTC().Format("20060102T150405.000000000"))
+	renameErr := os.Rename(filepath.Join(l.dir, auditFileName), filepath.Join(l.dir, rotated))
+	if files, err := l.rotatedFiles(); renameErr == nil && err == nil && len(files) > l.maxFiles {
+		for _, f := range files[:len(files)-l.maxFiles] {
+			_ = os.Remove(f)
+		}
+	}
+	// The current file is reopened even if it could not be renamed, so the
+	// log keeps growing rather than stopping.
+	if err := l.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+func (l *auditLog) rotatedFiles() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(l.dir, auditRotatedGlob))
+	sort.Strings(files)
+	return files, err
+}
+
+func (l *auditLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+type auditFilter struct {
+	namespace, key string
+	since, until   time.Time
+	limit          int
+}
+
+func (f auditFilter) match(r AuditRecord) bool {
+	return (f.namespace == "" || r.Namespace == f.namespace) &&
+		(f.key == "" || r.Key == f.key) &&
+		(f.since.IsZero() || !r.Time.Before(f.since)) &&
+		(f.until.IsZero() || r.Time.Before(f.until))
+}
+
+// query returns the newest records matching the filter, oldest first.
+func (l *auditLog) query(f auditFilter) ([]AuditRecord, error) {
+	// The files are opened under the lock, so rotation does not move records
+	// out of sight. Reading them does not block writes; a record being
+	// written is either read whole or skipped as invalid.
+	l.mutex.Lock()
+	names, err := l.rotatedFiles()
+	var files []*os.File
+	if err == nil {
+		for _, name := range append(names, filepath.Join(l.dir, auditFileName)) {
+			file, openErr := os.Open(name)
+			if openErr != nil {
+				err = openErr
+				break
+			}
+			files = append(files, file)
+		}
+	}
+	l.mutex.Unlock()
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]AuditRecord, 0)
+	for _, file := range files {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var r AuditRecord
+			if json.Unmarshal(scanner.Bytes(), &r) != nil || !f.match(r) {
+				continue
+			}
+			records = append(records, r)
+			if len(records) > f.limit {
+				records = records[1:]
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// handleAuditRequest answers queries of the audit log by namespace, key and
+// a time range given as RFC 3339 timestamps.
+func handleAuditRequest(l *auditLog, rw http.ResponseWriter, req *http.Request) {
+	if l == nil {
+		writeError(rw, "", errAuditDisabled)
+		return
+	}
+	if !allowMethods(rw, req, "GET") {
+		return
+	}
+	query := req.URL.Query()
+	f := auditFilter{namespace: query.Get("namespace"), key: query.Get("key"), limit: auditQueryLimit}
+	for name, t := range map[string]*time.Time{"since": &f.since, "until": &f.until} {
+		if value := query.Get(name); value != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				writeError(rw, "", badRequest("invalid %s: %s", name, err))
+				return
+			}
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > auditQueryLimit {
+			writeError(rw, "", badRequest("limit must be between 1 and %d", auditQueryLimit))
+			return
+		}
+		f.limit = limit
+	}
+
+	records, err := l.query(f)
+	if err != nil {
+		writeError(rw, "", err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, records)
+}
+
+// mutation is a key changed by a request, or a namespace if the key is empty.
+type mutation struct {
+	// namespace is set when it cannot be told from the request path.
+	namespace string
+	key       string
+	valueSize int
+}
+
+type auditKey struct{}
+
+// noteMutation records that the request is about to change a key. It returns
+// the function to call with the result of the change, or an error if the
+// change must not be applied because it could not be recorded. It does
+// nothing unless the audit log is enabled.
+func noteMutation(req *http.Request, key string, valueSize int) (func(error), error) {
+	return noteMutations(req, []mutation{{key: key, valueSize: valueSize}})
+}
+
+// noteNamespaceChange is like noteMutation for a request creating or
+// dropping a namespace.
+func noteNamespaceChange(req *http.Request, name string) (func(error), error) {
+	return noteMutations(req, []mutation{{namespace: name}})
+}
+
+// noteMutations records the changes of a batch, which are applied together
+// and share their result. The pending records are synced to disk before it
+// returns; the results are not, a crash leaves the changes pending.
+func noteMutations(req *http.Request, mutations []mutation) (func(error), error) {
+	l, ok := req.Context().Value(auditKey{}).(*auditLog)
+	if !ok || len(mutations) == 0 {
+		return func(error) {}, nil
+	}
+	namespace := auditNamespace(req)
+	records := make([]AuditRecord, len(mutations))
+	for i, m := range mutations {
+		if m.namespace == "" {
+			m.namespace = namespace
+		}
+		records[i] = AuditRecord{
+			ID:        l.nextID(),
+			Time:      time.Now().UTC(),
+			Client:    identity(req),
+			Remote:    req.RemoteAddr,
+			Method:    req.Method,
+			Path:      req.URL.Path,
+			Namespace: m.namespace,
+			Key:       m.key,
+			ValueSize: m.valueSize,
+			Result:    auditPending,
+		}
+	}
+	if err := l.writeAll(records, true); err != nil {
+		log.Printf("Failed to write the audit log: %s", err)
+		return nil, fmt.Errorf("%w: %v", errAuditWrite, err)
+	}
+
+	return func(err error) {
+		result, status, reason := auditOK, 0, ""
+		if err != nil {
+			result, reason = auditFailed, err.Error()
+			status, _ = errorStatus(err)
+		}
+		for i := range records {
+			records[i].Time = time.Now().UTC()
+			records[i].Result, records[i].Status, records[i].Reason = result, status, reason
+		}
+		if err := l.writeAll(records, false); err != nil {
+			log.Printf("Failed to write the audit log: %s", err)
+		}
+	}, nil
+}
+
+type identityKey struct{}
+
+// identity returns the name of the token the request has been authenticated
+// with, or an empty string.
+func identity(req *http.Request) string {
+	name, _ := req.Context().Value(identityKey{}).(string)
+	return name
+}
+
+// middleware lets the handlers of requests other than reads record their
+// mutations with noteMutation.
+func (l *auditLog) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			req = req.WithContext(context.WithValue(req.Context(), auditKey{}, l))
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// auditNamespace returns the namespace a request changes.
+func auditNamespace(req *http.Request) string {
+	if strings.HasPrefix(req.URL.Path, dbPathPrefix) {
+		namespace, _, _ := requestPath(req)
+		return namespace
+	}
+	return requestNamespace(req)
+}
+
+// writeDenied records a request rejected by the authenticator.
+func (l *auditLog) writeDenied(req *http.Request, client string, status int, reason string) {
+	namespace, key := "", ""
+	if strings.HasPrefix(req.URL.Path, dbPathPrefix) {
+		namespace, key, _ = requestPath(req)
+	}
+	err := l.write(AuditRecord{
+		Time:      time.Now().UTC(),
+		Client:    client,
+		Remote:    req.RemoteAddr,
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Namespace: namespace,
+		Key:       key,
+		Status:    status,
+		Result:    auditDenied,
+		Reason:    reason,
+	})
+	if err != nil {
+		log.Printf("Failed to write the audit log: %s", err)
+	}
+}
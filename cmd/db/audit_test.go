@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAuditLog(t *testing.T, maxSize int64, maxFiles int) *auditLog {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "test-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	l, err := openAuditLog(dir, maxSize, maxFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestAuditLog(t *testing.T) {
+	l := newTestAuditLog(t, 1<<20, 2)
+	auth, err := parseAuth(strings.NewReader(testAuthConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.audit = l
+	ns := newTestNamespaces(t, newTestDb(t), "orders")
+	handler := ns.middleware(auth.middleware(newHandler(ns, nil, nil, l, nil)))
+	do := func(token, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+	query := func(query string) []AuditRecord {
+		rw := do("ops-token", "GET", auditPath+"?"+query, "")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		var records []AuditRecord
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(&records))
+		return records
+	}
+
+	start := time.Now().UTC()
+	assert.Equal(t, http.StatusCreated, do("writer-token", "POST", "/db/team-a", `{"value":"value"}`).Code)
+	assert.Equal(t, http.StatusOK, do("writer-token", "GET", "/db/team-a", "").Code)
+	assert.Equal(t, http.StatusForbidden, do("writer-token", "POST", "/db/other", `{"value":"v"}`).Code)
+	assert.Equal(t, http.StatusOK, do("writer-token", "DELETE", "/db/team-a", "").Code)
+	assert.Equal(t, http.StatusCreated, do("writer-token", "POST", "/db/orders/_mput", `{"entries":[{"key":"1","value":"v"},{"key":"2","value":"vv"}]}`).Code)
+	assert.Equal(t, http.StatusCreated, do("ops-token", "POST", "/admin/namespaces", `{"name":"users"}`).Code)
+
+	// Every mutation is recorded as pending before it is applied, then with
+	// its result.
+	records := query("")
+	if assert.Len(t, records, 11) {
+		assert.Equal(t, "writer", records[0].Client)
+		assert.Equal(t, "POST", records[0].Method)
+		assert.Equal(t, "default", records[0].Namespace)
+		assert.Equal(t, 5, records[0].ValueSize)
+		assert.Equal(t, auditPending, records[0].Result)
+		assert.NotEmpty(t, records[0].ID)
+		assert.NotEmpty(t, records[0].Remote)
+		assert.False(t, records[0].Time.Before(start.Truncate(time.Second)))
+		assert.Equal(t, records[0].ID, records[1].ID)
+		assert.Equal(t, auditOK, records[1].Result)
+		assert.Equal(t, 5, records[1].ValueSize)
+
+		assert.Equal(t, "other", records[2].Key)
+		assert.Equal(t, auditDenied, records[2].Result)
+		assert.Equal(t, http.StatusForbidden, records[2].Status)
+		assert.NotEmpty(t, records[2].Reason)
+
+		assert.Equal(t, auditPending, records[5].Result)
+		assert.Equal(t, auditPending, records[6].Result, "a batch is recorded before any of it is written")
+		assert.Equal(t, auditOK, records[7].Result)
+		assert.NotEqual(t, records[5].ID, records[6].ID)
+
+		assert.Equal(t, "users", records[10].Namespace)
+		assert.Equal(t, "ops", records[10].Client)
+		assert.Equal(t, "", records[10].Key)
+		assert.Equal(t, auditOK, records[10].Result)
+	}
+
+	records = query("key=team-a")
+	if assert.Len(t, records, 4) {
+		assert.Equal(t, "POST", records[0].Method)
+		assert.Equal(t, "DELETE", records[3].Method)
+	}
+	records = query("namespace=orders")
+	if assert.Len(t, records, 4) {
+		assert.Equal(t, "1", records[0].Key)
+		assert.Equal(t, 2, records[3].ValueSize)
+	}
+	records = query("namespace=orders&limit=1")
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "2", records[0].Key)
+	}
+	assert.Empty(t, query("since="+time.Now().Add(time.Hour).Format(time.RFC3339)))
+	assert.Empty(t, query("until="+start.Add(-time.Hour).Format(time.RFC3339)))
+	assert.Len(t, query("since="+start.Add(-time.Hour).Format(time.RFC3339)), 11)
+
+	assert.Equal(t, http.StatusBadRequest, do("ops-token", "GET", auditPath+"?since=yesterday", "").Code)
+	assert.Equal(t, http.StatusBadRequest, do("ops-token", "GET", auditPath+"?limit=0", "").Code)
+	assert.Equal(t, http.StatusForbidden, do("writer-token", "GET", auditPath, "").Code)
+
+	t.Run("failed mutation", func(t *testing.T) {
+		rw := do("writer-token", "POST", "/db/team-b", `{"value":"`+strings.Repeat("v", storeConfig.MaxValueSize+1)+`"}`)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+		records := query("key=team-b")
+		if assert.Len(t, records, 2) {
+			assert.Equal(t, auditPending, records[0].Result)
+			assert.Equal(t, auditFailed, records[1].Result)
+			assert.Equal(t, http.StatusRequestEntityTooLarge, records[1].Status)
+			assert.NotEmpty(t, records[1].Reason)
+		}
+	})
+
+	t.Run("unwritable log", func(t *testing.T) {
+		assert.NoError(t, l.Close())
+		rw := do("writer-token", "POST", "/db/team-c", `{"value":"v"}`)
+		assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+		assert.Contains(t, rw.Body.String(), "audit_failed")
+		assert.Equal(t, http.StatusNotFound, do("writer-token", "GET", "/db/team-c", "").Code, "mutations that cannot be recorded are not applied")
+	})
+}
+
+func TestAuditLog_Disabled(t *testing.T) {
+	handler := newHandler(newTestNamespaces(t, newTestDb(t)), nil, nil, nil, nil)
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("GET", auditPath, nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
+
+func TestAuditLog_Rotation(t *testing.T) {
+	l := newTestAuditLog(t, 300, 2)
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, l.write(AuditRecord{Time: time.Now().UTC(), Method: "POST", Key: string(rune('a' + i)), Result: auditOK}))
+	}
+	files, err := l.rotatedFiles()
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+	for _, file := range append(files, filepath.Join(l.dir, auditFileName)) {
+		info, err := os.Stat(file)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, info.Size(), int64(300))
+	}
+
+	records, err := l.query(auditFilter{limit: auditQueryLimit})
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, records) && assert.Less(t, len(records), 20) {
+		assert.Equal(t, "t", records[len(records)-1].Key)
+		for i := 1; i < len(records); i++ {
+			assert.Less(t, records[i-1].Key, records[i].Key)
+		}
+	}
+
+	assert.NoError(t, l.Close())
+	assert.ErrorIs(t, l.write(AuditRecord{}), errAuditClosed)
+}
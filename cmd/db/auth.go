@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Tokens are given in a JSON file:
+//
+//	{"tokens": [
+//	  {"name": "server", "token": "...", "permissions": [
+//	    {"namespace": "default", "prefix": "team-", "access": "rw"},
+//	    {"namespace": "*", "access": "r"}
+//	  ]},
+//	  {"name": "ops", "token": "...", "admin": true}
+//	]}
+//
+// A permission grants access to the keys of a namespace, or of all of them
+// for "*", starting with the prefix. Admin tokens may also use the endpoints
+// outside /db/, such as /admin/stats and /replication/log. /health and
+// /metrics are open to everyone.
+type AuthConfig struct {
+	Tokens []TokenConfig `json:"tokens"`
+}
+
+type TokenConfig struct {
+	Name        string       `json:"name"`
+	Token       string       `json:"token"`
+	Admin       bool         `json:"admin"`
+	Permissions []Permission `json:"permissions"`
+}
+
+type Permission struct {
+	Namespace string `json:"namespace"`
+	Prefix    string `json:"prefix"`
+	// Access is r, w or rw.
+	Access string `json:"access"`
+}
+
+type access int
+
+const (
+	accessRead access = 1 << iota
+	accessWrite
+)
+
+var accessModes = map[string]access{
+	"r":  accessRead,
+	"w":  accessWrite,
+	"rw": accessRead | accessWrite,
+}
+
+const anyNamespace = "*"
+
+var (
+	errAdminOnly    = errors.New("the endpoint requires an admin token")
+	errInvalidToken = errors.New("missing or invalid token")
+)
+
+// principal is the client a token belongs to.
+type principal struct {
+	name        string
+	admin       bool
+	permissions []Permission
+}
+
+// allowed reports whether the principal has the access to all keys of the
+// namespace starting with prefix, which is a single key unless the access
+// is for a watch.
+func (p *principal) allowed(namespace, prefix string, a access) bool {
+	for _, perm := range p.permissions {
+		if (perm.Namespace == namespace || perm.Namespace == anyNamespace) &&
+			strings.HasPrefix(prefix, perm.Prefix) && accessModes[perm.Access]&a == a {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticator checks the tokens of requests. Tokens are looked up by their
+// hash, so the lookup time does not depend on how much of a token matches.
+type authenticator struct {
+	principals map[[sha256.Size]byte]*principal
+	// audit receives the denied requests if the audit log is enabled.
+	audit *auditLog
+}
+
+func loadAuth(path string) (*authenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseAuth(f)
+}
+
+func parseAuth(r io.Reader) (*authenticator, error) {
+	var config AuthConfig
+	if err := json.NewDecoder(r).Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid auth config: %w", err)
+	}
+	a := &authenticator{principals: make(map[[sha256.Size]byte]*principal)}
+	names := make(map[string]bool)
+	for _, t := range config.Tokens {
+		if t.Name == "" || t.Token == "" {
+			return nil, fmt.Errorf("token %q has no name or no token", t.Name)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate token name %q", t.Name)
+		}
+		names[t.Name] = true
+		hash := sha256.Sum256([]byte(t.Token))
+		if _, ok := a.principals[hash]; ok {
+			return nil, fmt.Errorf("token %q is used twice", t.Name)
+		}
+		for _, perm := range t.Permissions {
+			if _, ok := accessModes[perm.Access]; !ok {
+				return nil, fmt.Errorf("token %q: invalid access %q, expected r, w or rw", t.Name, perm.Access)
+			}
+			if perm.Namespace != anyNamespace && !namespacePattern.MatchString(perm.Namespace) {
+				return nil, fmt.Errorf("token %q: %w: %q", t.Name, errInvalidNamespace, perm.Namespace)
+			}
+		}
+		a.principals[hash] = &principal{name: t.Name, admin: t.Admin, permissions: t.Permissions}
+	}
+	return a, nil
+}
+
+// authenticate returns the principal of the bearer token of the request, or
+// nil if there is no valid token.
+func (a *authenticator) authenticate(req *http.Request) *principal {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	return a.principals[sha256.Sum256([]byte(strings.TrimSpace(token)))]
+}
+
+// middleware rejects requests without a valid token with 401 and requests
+// the token does not permit with 403. Denied requests are logged and audited.
+// The name of the token is passed on in the context of the request.
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/health" || req.URL.Path == "/metrics" {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		p := a.authenticate(req)
+		if p == nil {
+			a.denied(req, "", http.StatusUnauthorized, errInvalidToken.Error())
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="db"`)
+			writeError(rw, "", &statusError{status: http.StatusUnauthorized, code: codeUnauthorized, err: errInvalidToken})
+			return
+		}
+		req = req.WithContext(context.WithValue(req.Context(), identityKey{}, p.name))
+		if err := authorize(p, rw, req); err != nil {
+			a.denied(req, p.name, http.StatusForbidden, err.Error())
+			writeError(rw, "", &statusError{status: http.StatusForbidden, code: codeForbidden, err: err})
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// authorize checks the keys a request reads or writes. The keys of batches
+// are read from the body, which is then restored for the handler. Requests
+// the handler rejects anyway, such as those with malformed paths or bodies,
+// are let through.
+func authorize(p *principal, rw http.ResponseWriter, req *http.Request) error {
+	if !strings.HasPrefix(req.URL.Path, dbPathPrefix) {
+		if !p.admin {
+			return errAdminOnly
+		}
+		return nil
+	}
+	namespace, key, err := requestPath(req)
+	if err != nil {
+		return nil
+	}
+
+	a := accessWrite
+	if req.Method == "GET" || req.Method == "HEAD" {
+		a = accessRead
+	}
+	var keys []string
+	switch key {
+	case watchName:
+		prefix := req.URL.Query().Get("prefix")
+		if !p.allowed(namespace, prefix, accessRead) {
+			return fmt.Errorf("%s may not watch %s/%s*", p.name, namespace, prefix)
+		}
+		return nil
+	case mgetName, mputName:
+		if key == mgetName {
+			a = accessRead
+		}
+		if keys, err = batchKeys(rw, req, key); err != nil {
+			return nil
+		}
+	default:
+		keys = []string{key}
+	}
+	for _, key := range keys {
+		if !p.allowed(namespace, key, a) {
+			verb := "write"
+			if a == accessRead {
+				verb = "read"
+			}
+			return fmt.Errorf("%s may not %s %s/%s", p.name, verb, namespace, key)
+		}
+	}
+	return nil
+}
+
+// batchKeys returns the keys of a batch request and puts the body back. A
+// body that cannot be read fails the same way for the handler.
+func batchKeys(rw http.ResponseWriter, req *http.Request, endpoint string) ([]string, error) {
+	data, err := io.ReadAll(http.MaxBytesReader(rw, req.Body, 2*int64(storeConfig.MaxValueSize)+maxBodyOverhead))
+	if err != nil {
+		req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data), failingReader{err}))
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	if endpoint == mgetName {
+		var body MGetReqBody
+		err := json.Unmarshal(data, &body)
+		return body.Keys, err
+	}
+	var body MPutReqBody
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(body.Entries))
+	for i, e := range body.Entries {
+		keys[i] = e.Key
+	}
+	return keys, nil
+}
+
+type failingReader struct {
+	err error
+}
+
+func (r failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func (a *authenticator) denied(req *http.Request, name string, status int, reason string) {
+	if a.audit != nil {
+		a.audit.writeDenied(req, name, status, reason)
+	}
+	if name == "" {
+		name = "anonymous"
+	}
+	log.Printf("Denied %s %s of %s from %s: %s", req.Method, req.URL.RequestURI(), name, req.RemoteAddr, reason)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAuthConfig = `{"tokens": [
+	{"name": "reader", "token": "reader-token", "permissions": [{"namespace": "*", "access": "r"}]},
+	{"name": "writer", "token": "writer-token", "permissions": [
+		{"namespace": "default", "prefix": "team-", "access": "rw"},
+		{"namespace": "orders", "access": "w"}
+	]},
+	{"name": "ops", "token": "ops-token", "admin": true}
+]}`
+
+func TestParseAuth(t *testing.T) {
+	for _, config := range []string{
+		`{"tokens": [{"name": "a"}]}`,
+		`{"tokens": [{"name": "a", "token": "x"}, {"name": "a", "token": "y"}]}`,
+		`{"tokens": [{"name": "a", "token": "x"}, {"name": "b", "token": "x"}]}`,
+		`{"tokens": [{"name": "a", "token": "x", "permissions": [{"namespace": "*", "access": "x"}]}]}`,
+		`{"tokens": [{"name": "a", "token": "x", "permissions": [{"namespace": "_a", "access": "r"}]}]}`,
+		`{"tokens": `,
+	} {
+		_, err := parseAuth(strings.NewReader(config))
+		assert.Error(t, err, config)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	auth, err := parseAuth(strings.NewReader(testAuthConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Db := newTestDb(t)
+	ns := newTestNamespaces(t, Db, "orders")
+	handler := ns.middleware(auth.middleware(newHandler(ns, nil, nil, nil, nil)))
+
+	cases := []struct {
+		name   string
+		token  string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"no token", "", "GET", "/db/team-a", "", http.StatusUnauthorized},
+		{"unknown token", "other", "GET", "/db/team-a", "", http.StatusUnauthorized},
+		{"open health", "", "GET", "/health", "", http.StatusOK},
+		{"write with prefix", "writer-token", "POST", "/db/team-a", `{"value":"v"}`, http.StatusCreated},
+		{"write outside prefix", "writer-token", "POST", "/db/other", `{"value":"v"}`, http.StatusForbidden},
+		{"read with prefix", "writer-token", "GET", "/db/team-a", "", http.StatusOK},
+		{"read of write-only namespace", "writer-token", "GET", "/db/orders/1", "", http.StatusForbidden},
+		{"write to write-only namespace", "writer-token", "POST", "/db/orders/1", `{"value":"v"}`, http.StatusCreated},
+		{"read anything", "reader-token", "GET", "/db/orders/1", "", http.StatusOK},
+		{"delete with read token", "reader-token", "DELETE", "/db/team-a", "", http.StatusForbidden},
+		{"batch write with prefix", "writer-token", "POST", "/db/_mput", `{"entries":[{"key":"team-b","value":"v"}]}`, http.StatusCreated},
+		{"batch write outside prefix", "writer-token", "POST", "/db/_mput", `{"entries":[{"key":"team-c","value":"v"},{"key":"c","value":"v"}]}`, http.StatusForbidden},
+		{"batch read with read token", "reader-token", "POST", "/db/_mget", `{"keys":["team-a"]}`, http.StatusOK},
+		{"malformed batch", "writer-token", "POST", "/db/_mput", `{"entries":`, http.StatusBadRequest},
+		{"watch outside prefix", "writer-token", "GET", "/db/_watch?prefix=x", "", http.StatusForbidden},
+		{"admin endpoint", "writer-token", "GET", "/admin/stats", "", http.StatusForbidden},
+		{"admin endpoint with admin token", "ops-token", "GET", "/admin/stats", "", http.StatusOK},
+		{"keys with admin token", "ops-token", "GET", "/db/team-a", "", http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			assert.Equal(t, tc.status, rw.Code)
+			if tc.status == http.StatusUnauthorized {
+				assert.NotEmpty(t, rw.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	_, err = Db.Get("team-c")
+	assert.Error(t, err, "a forbidden batch must not be written partially")
+}
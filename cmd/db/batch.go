@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+)
+
+const (
+	mgetName = "_mget"
+	mputName = "_mput"
+	mgetPath = dbPathPrefix + mgetName
+	mputPath = dbPathPrefix + mputName
+	// maxBatchKeys limits the number of keys of one batch request.
+	maxBatchKeys = 1000
+)
+
+var errTooManyKeys = fmt.Errorf("at most %d keys are allowed", maxBatchKeys)
+
+type MGetReqBody struct {
+	Keys []string `json:"keys"`
+}
+
+type MGetRespBody struct {
+	Values  map[string]string `json:"values"`
+	Missing []string          `json:"missing"`
+}
+
+type MPutReqBody struct {
+	Entries []RespBody `json:"entries"`
+}
+
+// decodeBatch reads the JSON body of a batch request into body, answering
+// the request itself when the body is not acceptable.
+func decodeBatch(rw http.ResponseWriter, req *http.Request, body interface{}) bool {
+	if !allowMethods(rw, req, "POST") {
+		return false
+	}
+	if err := decodeBody(rw, req, 2*int64(storeConfig.MaxValueSize)+maxBodyOverhead, body); err != nil {
+		writeError(rw, "", err)
+		return false
+	}
+	return true
+}
+
+func checkBatchKeys(rw http.ResponseWriter, keys []string) bool {
+	if len(keys) > maxBatchKeys {
+		writeError(rw, "", errTooManyKeys)
+		return false
+	}
+	for _, key := range keys {
+		if key == "" {
+			writeError(rw, key, errEmptyKey)
+			return false
+		}
+	}
+	return true
+}
+
+// handleMGetRequest returns the values of the requested keys and the list of
+// keys that do not exist. Db is nil if the namespace does not exist.
+func handleMGetRequest(Db Store, cl *cluster, rw http.ResponseWriter, req *http.Request) {
+	var body MGetReqBody
+	if !decodeBatch(rw, req, &body) || !checkBatchKeys(rw, body.Keys) {
+		return
+	}
+
+	values := make(map[string]string, len(body.Keys))
+	var mutex sync.Mutex
+	err := splitBatch(cl, req, body.Keys,
+		func(keys []int) error {
+			local := make([]string, len(keys))
+			for i, k := range keys {
+				local[i] = body.Keys[k]
+			}
+			if Db == nil {
+				// The namespace does not exist on this node.
+				return nil
+			}
+			found, err := Db.GetMany(req.Context(), local)
+			if err != nil {
+				return err
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			for key, value := range found {
+				values[key] = value
+			}
+			return nil
+		},
+		func(node *clusterNode, keys []int) error {
+			remote := MGetReqBody{Keys: make([]string, len(keys))}
+			for i, k := range keys {
+				remote.Keys[i] = body.Keys[k]
+			}
+			var resp MGetRespBody
+			if err := cl.forward(req, node, req.URL.EscapedPath(), remote, &resp); err != nil {
+				return err
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			for key, value := range resp.Values {
+				values[key] = value
+			}
+			return nil
+		})
+	if err != nil {
+		writeError(rw, "", err)
+		return
+	}
+
+	resp := MGetRespBody{Values: values, Missing: []string{}}
+	seen := make(map[string]bool, len(body.Keys))
+	for _, key := range body.Keys {
+		if _, ok := values[key]; !ok && !seen[key] {
+			resp.Missing = append(resp.Missing, key)
+		}
+		seen[key] = true
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(resp); err != nil {
+		log.Println("Error encoding response: ", err)
+	}
+}
+
+// handleMPutRequest writes the entries in order. The batch is not atomic: if
+// it fails, some of the entries may have been written.
+func handleMPutRequest(Db Store, cl *cluster, rw http.ResponseWriter, req *http.Request) {
+	var body MPutReqBody
+	if !decodeBatch(rw, req, &body) {
+		return
+	}
+	keys := make([]string, len(body.Entries))
+	for i, e := range body.Entries {
+		keys[i] = e.Key
+	}
+	if !checkBatchKeys(rw, keys) {
+		return
+	}
+	if err := chargeWrites(rw, req, len(keys)); err != nil {
+		writeError(rw, "", err)
+		return
+	}
+
+	entries := make([]*datastore.Entry, len(body.Entries))
+	mutations := make([]mutation, len(body.Entries))
+	for i, e := range body.Entries {
+		entries[i] = datastore.NewEntry(e.Key, e.Value)
+		mutations[i] = mutation{key: e.Key, valueSize: len(e.Value)}
+	}
+	done, err := noteMutations(req, mutations)
+	if err != nil {
+		writeError(rw, "", err)
+		return
+	}
+	err = putBatch(Db, cl, req, req.URL.EscapedPath(), entries)
+	done(err)
+	if err != nil {
+		writeError(rw, "", err)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// putBatch writes the entries locally or, in a cluster, on their owners by
+// sending them to the _mput endpoint at path.
+func putBatch(Db Store, cl *cluster, req *http.Request, path string, entries []*datastore.Entry) error {
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key()
+	}
+	return splitBatch(cl, req, keys,
+		func(indexes []int) error {
+			local := make([]*datastore.Entry, len(indexes))
+			for i, e := range indexes {
+				local[i] = entries[e]
+			}
+			return Db.PutMany(req.Context(), local)
+		},
+		func(node *clusterNode, indexes []int) error {
+			remote := MPutReqBody{Entries: make([]RespBody, len(indexes))}
+			for i, e := range indexes {
+				remote.Entries[i] = RespBody{Key: entries[e].Key(), Value: entries[e].Value()}
+			}
+			return cl.forward(req, node, path, remote, nil)
+		})
+}
+
+// splitBatch groups the keys of a batch by the node owning them and runs the
+// parts concurrently: local gets the indexes of the keys of this node, remote
+// those of another node. Without a cluster, every key is local.
+func splitBatch(cl *cluster, req *http.Request, keys []string, local func([]int) error, remote func(*clusterNode, []int) error) error {
+	if cl == nil {
+		all := make([]int, len(keys))
+		for i := range all {
+			all[i] = i
+		}
+		return local(all)
+	}
+
+	byNode := make(map[*clusterNode][]int)
+	for i, key := range keys {
+		owner := cl.owner(key)
+		byNode[owner] = append(byNode[owner], i)
+	}
+	if by := req.Header.Get(forwardedHeader); by != "" {
+		for node, indexes := range byNode {
+			if node.ID != cl.self {
+				return &statusError{
+					status: http.StatusMisdirectedRequest,
+					code:   codeMisdirected,
+					err:    fmt.Errorf("key %q forwarded by %s is owned by %s", keys[indexes[0]], by, node.ID),
+				}
+			}
+		}
+	}
+
+	errs := make([]error, 0, len(byNode))
+	var (
+		mutex sync.Mutex
+		wg    sync.WaitGroup
+	)
+	for node, indexes := range byNode {
+		wg.Add(1)
+		go func(node *clusterNode, indexes []int) {
+			defer wg.Done()
+			var err error
+			if node.ID == cl.self {
+				err = local(indexes)
+			} else {
+				err = remote(node, indexes)
+			}
+			if err != nil {
+				mutex.Lock()
+				errs = append(errs, err)
+				mutex.Unlock()
+			}
+		}(node, indexes)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
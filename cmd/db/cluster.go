@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore/sharded"
+)
+
+// forwardedHeader marks requests proxied by another node. A node receiving a
+// forwarded request for a key it does not own refuses it instead of
+// forwarding it again, so nodes with different membership cannot loop.
+const (
+	forwardedHeader = "X-Db-Forwarded-By"
+	nodeHeader      = "X-Db-Node"
+	// forwardTimeout limits batch requests sent to other nodes.
+	forwardTimeout = 10 * time.Second
+	// memberResolveInterval is how often the addresses of the members are
+	// looked up again.
+	memberResolveInterval = time.Minute
+)
+
+type clusterNode struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+
+	proxy *httputil.ReverseProxy
+}
+
+// cluster routes keys between db nodes with static membership. Every node
+// owns the ranges of the hash ring assigned to its id.
+type cluster struct {
+	self     string
+	nodes    []*clusterNode
+	ring     *sharded.Ring
+	redirect bool
+	client   *http.Client
+
+	addrMutex sync.Mutex
+	addrs     map[string]bool
+	resolved  time.Time
+}
+
+// parseCluster reads the membership given as comma-separated id=url pairs.
+// self must be one of the ids.
+func parseCluster(self, members string, redirect bool) (*cluster, error) {
+	c := &cluster{self: self, redirect: redirect, client: &http.Client{Timeout: forwardTimeout}}
+	seen := make(map[string]bool)
+	for _, member := range strings.Split(members, ",") {
+		id, rawURL, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid cluster member %q, expected id=url", member)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("duplicate cluster member %q", id)
+		}
+		seen[id] = true
+		target, err := url.Parse(rawURL)
+		if err != nil || target.Host == "" || (target.Scheme != "http" && target.Scheme != "https") {
+			return nil, fmt.Errorf("invalid URL of cluster member %q: %q", id, rawURL)
+		}
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+			log.Printf("Failed to proxy %s %s to %s: %s", req.Method, req.URL.RequestURI(), id, err)
+			writeError(rw, "", &forwardError{node: id, status: http.StatusBadGateway, code: codeForwardFailed, message: err.Error()})
+		}
+		c.nodes = append(c.nodes, &clusterNode{
+			ID:    id,
+			URL:   strings.TrimSuffix(rawURL, "/"),
+			proxy: proxy,
+		})
+	}
+	if !seen[self] {
+		return nil, fmt.Errorf("node %q is not a member of the cluster", self)
+	}
+
+	// Nodes are sorted, so the ring does not depend on the order of the flag.
+	sort.Slice(c.nodes, func(i, j int) bool { return c.nodes[i].ID < c.nodes[j].ID })
+	ids := make([]string, len(c.nodes))
+	for i, n := range c.nodes {
+		ids[i] = n.ID
+	}
+	c.ring = sharded.NewRing(ids...)
+	return c, nil
+}
+
+func (c *cluster) owner(key string) *clusterNode {
+	return c.nodes[c.ring.Locate(key)]
+}
+
+// route sends a request for a key owned by another node to that node, either
+// by proxying it or by redirecting the client. It reports whether the request
+// has been handled.
+func (c *cluster) route(rw http.ResponseWriter, req *http.Request, key string) bool {
+	owner := c.owner(key)
+	rw.Header().Set(nodeHeader, owner.ID)
+	if owner.ID == c.self {
+		return false
+	}
+	if by := req.Header.Get(forwardedHeader); by != "" {
+		log.Printf("Refusing key %q forwarded by %s, it is owned by %s", key, by, owner.ID)
+		writeError(rw, key, &statusError{
+			status: http.StatusMisdirectedRequest,
+			code:   codeMisdirected,
+			err:    fmt.Errorf("key %q forwarded by %s is owned by %s", key, by, owner.ID),
+		})
+		return true
+	}
+	if c.redirect {
+		http.Redirect(rw, req, owner.URL+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return true
+	}
+	req.Header.Set(forwardedHeader, c.self)
+	owner.proxy.ServeHTTP(rw, req)
+	return true
+}
+
+// forwardError is returned when another node refuses a forwarded batch. The
+// status, and the code and the message of the error response of the node, are
+// passed on to the client.
+type forwardError struct {
+	node    string
+	status  int
+	code    string
+	message string
+}
+
+func (e *forwardError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("node %s answered with status %d", e.node, e.status)
+	}
+	return fmt.Sprintf("node %s answered with status %d: %s", e.node, e.status, e.message)
+}
+
+// forward sends the part of a batch of the request owned by node to it as
+// JSON and decodes the response into out, unless out is nil. The token of the
+// request is passed on, so the owner checks it too.
+func (c *cluster) forward(orig *http.Request, node *clusterNode, path string, in, out interface{}) error {
+	return c.send(orig, node, "POST", path, in, out)
+}
+
+// broadcast sends a request to every other node, unless orig has been
+// forwarded by a node already, and returns the first error. A node answering
+// 404 counts as done if missingOK is set.
+func (c *cluster) broadcast(orig *http.Request, method, path string, in interface{}, missingOK bool) error {
+	if orig.Header.Get(forwardedHeader) != "" {
+		return nil
+	}
+	var first error
+	for _, node := range c.nodes {
+		if node.ID == c.self {
+			continue
+		}
+		err := c.send(orig, node, method, path, in, nil)
+		if fwdErr, ok := err.(*forwardError); ok && missingOK && fwdErr.status == http.StatusNotFound {
+			err = nil
+		}
+		if err != nil {
+			log.Printf("Failed to send %s %s to %s: %s", method, path, node.ID, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// send sends a request with in as its JSON body, unless in is nil, and
+// decodes the response into out, unless out is nil.
+func (c *cluster) send(orig *http.Request, node *clusterNode, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(orig.Context(), method, node.URL+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	req.Header.Set(forwardedHeader, c.self)
+	if auth := orig.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return &forwardError{node: node.ID, status: http.StatusBadGateway, code: codeForwardFailed}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		fwdErr := &forwardError{node: node.ID, status: resp.StatusCode, code: codeForwardFailed}
+		var body ErrorRespBody
+		if json.NewDecoder(io.LimitReader(resp.Body, maxBodyOverhead)).Decode(&body) == nil && body.Code != "" {
+			fwdErr.code, fwdErr.message = body.Code, body.Message
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return fwdErr
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// fromMember reports whether a request comes from the address of a member.
+// The host names of the members are looked up at most once in
+// memberResolveInterval; a failed lookup keeps the addresses found before.
+// Nodes sharing a host with clients cannot be told apart from them.
+func (c *cluster) fromMember(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	c.addrMutex.Lock()
+	defer c.addrMutex.Unlock()
+	if now := time.Now(); c.addrs == nil || now.Sub(c.resolved) >= memberResolveInterval {
+		c.resolveMembers()
+		c.resolved = now
+	}
+	return c.addrs[ip.String()]
+}
+
+// resolveMembers looks up the addresses of the members. The caller must hold
+// addrMutex.
+func (c *cluster) resolveMembers() {
+	addrs := make(map[string]bool)
+	for _, n := range c.nodes {
+		target, err := url.Parse(n.URL)
+		if err != nil {
+			continue
+		}
+		ips, err := net.LookupIP(target.Hostname())
+		if err != nil {
+			log.Printf("Failed to look up cluster member %s: %s", n.ID, err)
+			for addr := range c.addrs {
+				addrs[addr] = true
+			}
+			continue
+		}
+		for _, ip := range ips {
+			addrs[ip.String()] = true
+		}
+	}
+	c.addrs = addrs
+}
+
+type ownerResponse struct {
+	Key  string `json:"key"`
+	Node string `json:"node"`
+	URL  string `json:"url"`
+}
+
+// handleOwnerRequest tells which node owns the key given in the query.
+func handleOwnerRequest(c *cluster, rw http.ResponseWriter, req *http.Request) {
+	if c == nil {
+		writeError(rw, "", errNoCluster)
+		return
+	}
+	if !allowMethods(rw, req, "GET") {
+		return
+	}
+	key := req.URL.Query().Get("key")
+	if key == "" {
+		writeError(rw, "", errEmptyKey)
+		return
+	}
+	owner := c.owner(key)
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(ownerResponse{Key: key, Node: owner.ID, URL: owner.URL}); err != nil {
+		log.Println("Error encoding response: ", err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+type testNode struct {
+	id     string
+	db     *datastore.Db
+	ns     *namespaces
+	server *httptest.Server
+}
+
+// startCluster starts nodes listening on localhost ports, all sharing the
+// same static membership.
+func startCluster(t *testing.T, ids []string, redirect bool) map[string]*testNode {
+	t.Helper()
+	nodes := make(map[string]*testNode)
+	var members []string
+	for _, id := range ids {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := httptest.NewUnstartedServer(nil)
+		server.Listener.Close()
+		server.Listener = l
+		nodes[id] = &testNode{id: id, db: newTestDb(t), server: server}
+		members = append(members, fmt.Sprintf("%s=http://%s", id, l.Addr()))
+	}
+	for _, n := range nodes {
+		cl, err := parseCluster(n.id, strings.Join(members, ","), redirect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.ns = newTestNamespaces(t, n.db)
+		n.server.Config.Handler = newHandler(n.ns, nil, cl, nil, nil)
+		n.server.Start()
+		t.Cleanup(n.server.Close)
+	}
+	return nodes
+}
+
+func TestCluster(t *testing.T) {
+	nodes := startCluster(t, []string{"a", "b", "c"}, false)
+	a, b := nodes["a"], nodes["b"]
+
+	keys := make([]string, 30)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		resp, err := http.Post(a.server.URL+"/db/"+keys[i], "application/json", strings.NewReader(`{"value":"v"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	t.Run("store keys on their owners", func(t *testing.T) {
+		owned := make(map[string]int)
+		for _, key := range keys {
+			resp, err := http.Get(b.server.URL + "/cluster/owner?key=" + key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var owner ownerResponse
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&owner))
+			resp.Body.Close()
+			owned[owner.Node]++
+
+			for id, n := range nodes {
+				_, err := n.db.Get(key)
+				if id == owner.Node {
+					assert.NoError(t, err, "key %s is missing on its owner %s", key, id)
+				} else {
+					assert.Equal(t, datastore.ErrNotFound, err, "key %s is stored on %s", key, id)
+				}
+			}
+		}
+		assert.Len(t, owned, 3, "keys should be spread over all nodes")
+	})
+
+	t.Run("proxy reads to the owner", func(t *testing.T) {
+		for _, key := range keys {
+			resp, err := http.Get(b.server.URL + "/db/" + key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body RespBody
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "v", body.Value)
+		}
+	})
+
+	t.Run("split batches between the owners", func(t *testing.T) {
+		var entries []RespBody
+		for _, key := range keys {
+			entries = append(entries, RespBody{Key: key, Value: "batch"})
+		}
+		data, _ := json.Marshal(MPutReqBody{Entries: entries})
+		resp, err := http.Post(b.server.URL+mputPath, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		data, _ = json.Marshal(MGetReqBody{Keys: append([]string{"missing"}, keys...)})
+		resp, err = http.Post(a.server.URL+mgetPath, "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body MGetRespBody
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		resp.Body.Close()
+		assert.Len(t, body.Values, len(keys))
+		for _, key := range keys {
+			assert.Equal(t, "batch", body.Values[key])
+		}
+		assert.Equal(t, []string{"missing"}, body.Missing)
+	})
+
+	t.Run("refuse forwarded requests for other nodes", func(t *testing.T) {
+		for _, key := range keys {
+			req, _ := http.NewRequest("GET", a.server.URL+"/db/"+key, nil)
+			req.Header.Set(forwardedHeader, "b")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if owner := resp.Header.Get(nodeHeader); owner == "a" {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			} else {
+				assert.Equal(t, http.StatusMisdirectedRequest, resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("create and drop namespaces on every node", func(t *testing.T) {
+		resp, err := http.Post(a.server.URL+namespacesAdminPath, "application/json", strings.NewReader(`{"name":"users"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		for _, n := range nodes {
+			assert.True(t, n.ns.exists("users"), n.id)
+		}
+
+		for _, key := range keys {
+			resp, err := http.Post(b.server.URL+"/db/users/"+key, "application/json", strings.NewReader(`{"value":"user"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		}
+
+		// A node that missed the drop has it repeated.
+		assert.NoError(t, nodes["c"].ns.drop("users"))
+		req, _ := http.NewRequest("DELETE", b.server.URL+namespacesAdminPath+"/users", nil)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		for _, n := range nodes {
+			assert.False(t, n.ns.exists("users"), n.id)
+		}
+	})
+}
+
+func TestCluster_Redirect(t *testing.T) {
+	nodes := startCluster(t, []string{"a", "b"}, true)
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		resp, err := client.Get(nodes["a"].server.URL + "/db/" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Header.Get(nodeHeader) == "b" {
+			assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+			assert.Equal(t, nodes["b"].server.URL+"/db/"+key, resp.Header.Get("Location"))
+		} else {
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		}
+	}
+}
+
+func TestParseCluster(t *testing.T) {
+	for _, members := range []string{"a", "a=ftp://x", "a=http://x,a=http://y", "b=http://x"} {
+		_, err := parseCluster("a", members, false)
+		assert.Error(t, err, members)
+	}
+	cl, err := parseCluster("a", "b=http://y, a=http://x/", false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "http://x", cl.nodes[0].URL)
+	}
+}
+
+func TestCluster_FromMember(t *testing.T) {
+	cl, err := parseCluster("a", "a=http://127.0.0.1:8080,b=http://192.0.2.7:8080", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for remote, expected := range map[string]bool{
+		"192.0.2.7:41000": true,
+		"127.0.0.1:41000": true,
+		"192.0.2.8:41000": false,
+		"invalid":         false,
+	} {
+		req := httptest.NewRequest("GET", "/db/key", nil)
+		req.RemoteAddr = remote
+		assert.Equal(t, expected, cl.fromMember(req), remote)
+	}
+}
@@ -1,18 +1,63 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
-	"io/ioutil"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+	"github.com/NikitaSutulov/software-architecture-lab4/dbconfig"
+	"github.com/NikitaSutulov/software-architecture-lab4/dbproto"
+	"github.com/NikitaSutulov/software-architecture-lab4/dbresp"
 	"github.com/NikitaSutulov/software-architecture-lab4/httptools"
 	"github.com/NikitaSutulov/software-architecture-lab4/signal"
 )
 
-var port = flag.Int("port", 8083, "server port")
+var (
+	port            = flag.Int("port", 8083, "server port")
+	binaryPort      = flag.Int("binary-port", 0, "port of the binary protocol server; disabled when 0")
+	respPort        = flag.Int("resp-port", 0, "port of the Redis protocol (RESP2) server; disabled when 0")
+	dataDir         = flag.String("dir", "", "data directory, kept across restarts; a new temporary directory is used when empty")
+	node            = flag.String("node", "", "id of this node in the cluster")
+	clusterMembers  = flag.String("cluster", "", "cluster members as comma-separated id=url pairs; defaults to DB_CLUSTER")
+	clusterRedirect = flag.Bool("cluster-redirect", false, "redirect requests for keys owned by other nodes instead of proxying them")
+	primary         = flag.String("primary", "", "URL of the primary to replicate from; the server runs as a read-only replica when set")
+	primaryToken    = flag.String("primary-token", "", "token to replicate from a primary requiring authentication; defaults to DB_PRIMARY_TOKEN")
+	authFile        = flag.String("auth-file", "", "JSON file with the API tokens and their permissions; authentication is disabled when empty")
+	auditDir        = flag.String("audit-dir", "", "directory of the audit log of mutations, kept apart from the data; the audit log is disabled when empty")
+	auditMaxSize    = flag.Int64("audit-max-size", 10<<20, "size in bytes at which the audit log is rotated")
+	auditMaxFiles   = flag.Int("audit-max-files", 10, "number of rotated audit log files to keep")
+	clientRate      = flag.Float64("client-rate", 0, "requests per second allowed to every client; unlimited when 0")
+	clientBurst     = flag.Int("client-burst", 20, "number of requests a client may make at once over its rate")
+	clientHeader    = flag.String("client-header", "", "header identifying the client for its rate limit, such as X-Client-Id; the remote address is used when empty or missing")
+	writeRate       = flag.Float64("write-rate", 0, "writes per second allowed to all clients together; unlimited when 0")
+	writeBurst      = flag.Int("write-burst", 100, "number of writes allowed at once over the write rate")
+	storeConfig     = newStoreConfig()
+)
+
+// newStoreConfig defines the flags of the store, shared with cmd/dbtool.
+func newStoreConfig() *dbconfig.Config {
+	var c dbconfig.Config
+	c.RegisterFlags(flag.CommandLine)
+	return &c
+}
+
+const (
+	confCluster      = "DB_CLUSTER"
+	confPrimaryToken = "DB_PRIMARY_TOKEN"
+	// maxBodyOverhead leaves room for the JSON envelope and escaping around
+	// a value of the maximum size.
+	maxBodyOverhead = 1 << 10
+	shutdownTimeout = 10 * time.Second
+)
 
 type RespBody struct {
 	Key   string `json:"key"`
@@ -23,69 +68,431 @@ type ReqBody struct {
 	Value string `json:"value"`
 }
 
-func handleDbRequests(Db *datastore.Db, rw http.ResponseWriter, req *http.Request) {
-	url := req.URL.String()
-	key := url[4:]
+const dbPathPrefix = "/db/"
+
+var errEmptyKey = errors.New("key is empty")
+
+// requestPath returns the namespace and the key addressed by a request to
+// /db/<namespace>/<key> or, for the default namespace, /db/<key>, as resolved
+// by namespaces.middleware. A request it has not seen is resolved as if only
+// the default namespace existed.
+func requestPath(req *http.Request) (namespace, key string, err error) {
+	if p, ok := req.Context().Value(requestPathKey{}).(*resolvedPath); ok {
+		return p.namespace, p.key, p.err
+	}
+	return resolvePath(req, nil)
+}
+
+// resolvePath takes the namespace and the key from the escaped path, so the
+// key may contain slashes and escaped ones. The key never includes the query
+// string. Endpoints such as _mget are returned in place of the key.
+//
+// The first segment of the path names a namespace only if it is "default",
+// exists reports it, or an endpoint follows it. Otherwise the whole path is a
+// key of the default namespace, as before namespaces: POST /db/a/b writes the
+// key a/b unless the namespace a exists. Once a is created, the key a/b of the
+// default namespace is reached as /db/default/a/b or /db/a%2Fb.
+func resolvePath(req *http.Request, exists func(namespace string) bool) (namespace, key string, err error) {
+	escaped, ok := strings.CutPrefix(req.URL.EscapedPath(), dbPathPrefix)
+	if !ok {
+		return "", "", fmt.Errorf("%w: %q is not under %s", errInvalidPath, req.URL.EscapedPath(), dbPathPrefix)
+	}
+	namespace = defaultNamespace
+	if first, rest, found := strings.Cut(escaped, "/"); found {
+		name, err := url.PathUnescape(first)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: %s", errInvalidPath, err)
+		}
+		endpoint, _ := url.PathUnescape(rest)
+		if name == defaultNamespace || isReservedKey(endpoint) || (exists != nil && exists(name)) {
+			if !namespacePattern.MatchString(name) {
+				return "", "", errInvalidNamespace
+			}
+			namespace, escaped = name, rest
+		}
+	}
+	if key, err = url.PathUnescape(escaped); err != nil {
+		return "", "", fmt.Errorf("%w: %s", errInvalidPath, err)
+	}
+	if key == "" {
+		return "", "", errEmptyKey
+	}
+	return namespace, key, nil
+}
+
+func handleDbRequests(ns *namespaces, repl *replicator, cl *cluster, rw http.ResponseWriter, req *http.Request) {
+	namespace, key, err := requestPath(req)
+	if err != nil {
+		writeError(rw, "", err)
+		return
+	}
+	// Batch reads are POST requests, but a replica serves them as well.
+	isRead := req.Method == "GET" || req.Method == "HEAD" || key == mgetName || key == watchName
+	if !isReservedKey(key) && !allowMethods(rw, req, "GET", "HEAD", "POST", "DELETE") {
+		return
+	}
+	if repl != nil && !isRead && !repl.acceptsWrites() {
+		writeError(rw, key, errReplica)
+		return
+	}
+
+	// Namespaces are created through /admin/namespaces only, so a write to a
+	// mistyped namespace fails instead of creating one.
+	Db, err := ns.get(namespace)
+	if err != nil {
+		writeHeadError(rw, req, "", err)
+		return
+	}
 
-	switch req.Method {
-	case "GET":
-		handleGetRequest(Db, rw, key)
-	case "POST":
+	switch {
+	case key == watchName:
+		handleWatchRequest(Db, shutdown, rw, req)
+	case key == mgetName:
+		handleMGetRequest(Db, cl, rw, req)
+	case key == mputName:
+		handleMPutRequest(Db, cl, rw, req)
+	case req.Method == "GET" || req.Method == "HEAD":
+		handleGetRequest(Db, rw, req, key)
+	case req.Method == "POST":
 		handlePostRequest(Db, rw, req, key)
 	default:
-		rw.WriteHeader(http.StatusBadRequest)
+		handleDeleteRequest(Db, rw, req, key)
 	}
 }
 
-func handleGetRequest(Db *datastore.Db, rw http.ResponseWriter, key string) {
-	value, err := Db.Get(key)
+// isReservedKey reports whether key names an endpoint under /db/ rather than
+// a key. Batch endpoints split their keys between the nodes themselves.
+func isReservedKey(key string) bool {
+	return key == watchName || key == mgetName || key == mputName
+}
+
+// valueSizeHeader gives the size of the value in bytes, as Content-Length is
+// the size of the JSON body around it.
+const valueSizeHeader = "X-Db-Value-Size"
+
+// handleGetRequest serves GET and HEAD requests. The ETag of a value is the
+// sequence number of the write that stored it, so it changes with every write
+// of the key.
+func handleGetRequest(Db Store, rw http.ResponseWriter, req *http.Request, key string) {
+	record, err := Db.GetRecordContext(req.Context(), key)
 	if err != nil {
-		rw.WriteHeader(http.StatusNotFound)
+		writeHeadError(rw, req, key, err)
 		return
 	}
-	rw.WriteHeader(http.StatusOK)
-	rw.Header().Set("content-type", "application/json")
-	if err := json.NewEncoder(rw).Encode(RespBody{Key: key, Value: value}); err != nil {
+	etag := fmt.Sprintf(`"%x"`, record.Seq)
+	rw.Header().Set("ETag", etag)
+	rw.Header().Set("Last-Modified", record.Modified.UTC().Format(http.TimeFormat))
+	if etagMatches(req.Header.Get("If-None-Match"), etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body, err := json.Marshal(RespBody{Key: key, Value: record.Value})
+	if err != nil {
 		log.Println("Error encoding response: ", err)
+		writeHeadError(rw, req, key, err)
+		return
+	}
+	body = append(body, '\n')
+	rw.Header().Set("content-type", "application/json")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.Header().Set(valueSizeHeader, strconv.Itoa(len(record.Value)))
+	rw.WriteHeader(http.StatusOK)
+	if req.Method != "HEAD" {
+		_, _ = rw.Write(body)
 	}
 }
 
-func handlePostRequest(Db *datastore.Db, rw http.ResponseWriter, req *http.Request, key string) {
-	var body ReqBody
+// writeHeadError answers a GET request with the error and a HEAD request
+// with its status only, as HEAD responses have no body.
+func writeHeadError(rw http.ResponseWriter, req *http.Request, key string, err error) {
+	if req.Method == "HEAD" {
+		status, _ := errorStatus(err)
+		rw.WriteHeader(status)
+		return
+	}
+	writeError(rw, key, err)
+}
 
-	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
-		rw.WriteHeader(http.StatusBadRequest)
+// etagMatches reports whether the If-None-Match header lists etag. Weak tags
+// are compared by their opaque part, as the header requires.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func handlePostRequest(Db Store, rw http.ResponseWriter, req *http.Request, key string) {
+	var body ReqBody
+	if err := decodeBody(rw, req, 2*int64(storeConfig.MaxValueSize)+maxBodyOverhead, &body); err != nil {
+		writeError(rw, key, err)
 		return
 	}
 
-	if err := Db.Put(key, body.Value); err != nil {
-		rw.WriteHeader(http.StatusInternalServerError)
+	done, err := noteMutation(req, key, len(body.Value))
+	if err != nil {
+		writeError(rw, key, err)
+		return
+	}
+	err = Db.PutContext(req.Context(), key, body.Value)
+	done(err)
+	if err != nil {
+		writeError(rw, key, err)
 		return
 	}
 	rw.WriteHeader(http.StatusCreated)
 }
 
+func handleDeleteRequest(Db Store, rw http.ResponseWriter, req *http.Request, key string) {
+	done, err := noteMutation(req, key, 0)
+	if err != nil {
+		writeError(rw, key, err)
+		return
+	}
+	err = Db.DeleteContext(req.Context(), key)
+	done(err)
+	if err != nil {
+		writeError(rw, key, err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func healthHandler(Db statsSource, rw http.ResponseWriter) {
+	rw.Header().Set("content-type", "text/plain")
+	if err := Db.Degraded(); err != nil {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = rw.Write([]byte("READ-ONLY: " + err.Error()))
+	} else {
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("OK"))
+	}
+}
+
+// newHandler routes the requests of the db service. repl is nil unless the
+// service runs as a replica, cl is nil unless it is a node of a cluster.
+// audit is nil unless the audit log is enabled, limiter unless requests are
+// rate limited. The limiter only provides statistics here; the caller wraps the
+// handler in its middleware, so that it runs before authentication. The
+// caller wraps the handler in the middleware of ns as well when it adds
+// middlewares of its own, so that they see the same namespaces.
+func newHandler(ns *namespaces, repl *replicator, cl *cluster, audit *auditLog, limiter *rateLimiter) http.Handler {
+	dbHandler := func(rw http.ResponseWriter, req *http.Request) {
+		if cl != nil {
+			if _, key, err := requestPath(req); err == nil && !isReservedKey(key) && cl.route(rw, req, key) {
+				return
+			}
+		}
+		handleDbRequests(ns, repl, cl, rw, req)
+	}
+
+	h := http.NewServeMux()
+	h.HandleFunc("/health", func(rw http.ResponseWriter, req *http.Request) {
+		if allowMethods(rw, req, "GET", "HEAD") {
+			healthHandler(ns, rw)
+		}
+	})
+	h.HandleFunc("/admin/stats", func(rw http.ResponseWriter, req *http.Request) {
+		if allowMethods(rw, req, "GET") {
+			handleStatsRequest(ns, limiter, rw)
+		}
+	})
+	h.HandleFunc("/admin/export", func(rw http.ResponseWriter, req *http.Request) {
+		handleExportRequest(ns, rw, req)
+	})
+	h.HandleFunc("/admin/import", func(rw http.ResponseWriter, req *http.Request) {
+		handleImportRequest(ns, repl, cl, rw, req)
+	})
+	h.HandleFunc(namespacesAdminPath, func(rw http.ResponseWriter, req *http.Request) {
+		handleNamespacesRequest(ns, repl, cl, rw, req)
+	})
+	h.HandleFunc(namespacesAdminPath+"/", func(rw http.ResponseWriter, req *http.Request) {
+		handleNamespacesRequest(ns, repl, cl, rw, req)
+	})
+	h.HandleFunc(auditPath, func(rw http.ResponseWriter, req *http.Request) {
+		handleAuditRequest(audit, rw, req)
+	})
+	h.HandleFunc("/metrics", func(rw http.ResponseWriter, req *http.Request) {
+		if allowMethods(rw, req, "GET") {
+			handleMetricsRequest(ns, limiter, rw)
+		}
+	})
+	h.HandleFunc(replicationLogPath, func(rw http.ResponseWriter, req *http.Request) {
+		handleReplicationLog(ns, rw, req)
+	})
+	h.HandleFunc("/replication/status", func(rw http.ResponseWriter, req *http.Request) {
+		handleReplicationStatus(repl, rw, req)
+	})
+	h.HandleFunc("/cluster/owner", func(rw http.ResponseWriter, req *http.Request) {
+		handleOwnerRequest(cl, rw, req)
+	})
+	h.HandleFunc("/replication/promote", func(rw http.ResponseWriter, req *http.Request) {
+		handlePromoteRequest(repl, rw, req)
+	})
+	h.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		writeError(rw, "", errNoEndpoint)
+	})
+	handler := http.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// Requests for keys bypass the mux, which would clean their paths and
+		// redirect keys with empty segments or dots in them.
+		if strings.HasPrefix(req.URL.Path, dbPathPrefix) {
+			dbHandler(rw, req)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	}))
+	if audit != nil {
+		handler = audit.middleware(handler)
+	}
+	return ns.middleware(handler)
+}
+
 func main() {
 	flag.Parse()
-	h := http.NewServeMux()
+	dir := *dataDir
+	if dir == "" {
+		var err error
+		if dir, err = os.MkdirTemp("", "temp-dir"); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("No data directory given, the data is stored in %s", dir)
+	}
 
-	dir, err := ioutil.TempDir("", "temp-dir")
+	opts, err := storeConfig.Options()
 	if err != nil {
 		log.Fatal(err)
 	}
-
-	Db, err := datastore.NewDb(dir, 45)
+	Db, err := storeConfig.Open(dir, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer Db.Close()
-
-	h.HandleFunc("/db/", func(rw http.ResponseWriter, req *http.Request) {
-		handleDbRequests(Db, rw, req)
+	// The shard directories hold the default namespace, the other ones are
+	// sharded within their own directories.
+	nsConfig := storeConfig.Nested()
+	ns, err := newNamespaces(dir, Db, func(dir string) (Store, error) {
+		return nsConfig.Open(dir, opts...)
 	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var repl *replicator
+	if *primary != "" {
+		if err := validPrimaryURL(*primary); err != nil {
+			log.Fatal(err)
+		}
+		repl = newReplicator(strings.TrimSuffix(*primary, "/"), ns)
+		repl.token = *primaryToken
+		if repl.token == "" {
+			repl.token = os.Getenv(confPrimaryToken)
+		}
+		repl.start()
+	}
+
+	var cl *cluster
+	if *clusterMembers == "" {
+		*clusterMembers = os.Getenv(confCluster)
+	}
+	if *clusterMembers != "" {
+		cl, err = parseCluster(*node, *clusterMembers, *clusterRedirect)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var audit *auditLog
+	if *auditDir != "" {
+		// Mutations over the binary and RESP protocols are not audited.
+		if *binaryPort != 0 || *respPort != 0 {
+			log.Fatal("The binary and RESP protocols cannot be used with the audit log")
+		}
+		audit, err = openAuditLog(*auditDir, *auditMaxSize, *auditMaxFiles)
+		if err != nil {
+			log.Fatalf("Failed to open the audit log: %s", err)
+		}
+	}
 
-	server := httptools.CreateServer(*port, h)
+	var limiter *rateLimiter
+	if *clientRate > 0 || *writeRate > 0 {
+		limiter, err = newRateLimiter(*clientRate, *clientBurst, *writeRate, *writeBurst, *clientHeader)
+		if err != nil {
+			log.Fatalf("Invalid rate limits: %s", err)
+		}
+		// Requests of the binary and RESP protocols are not limited.
+		if *binaryPort != 0 || *respPort != 0 {
+			log.Fatal("The binary and RESP protocols cannot be used with rate limits")
+		}
+		if cl != nil {
+			limiter.fromPeer = cl.fromMember
+		}
+	}
+
+	handler := newHandler(ns, repl, cl, audit, limiter)
+	if *authFile != "" {
+		auth, err := loadAuth(*authFile)
+		if err != nil {
+			log.Fatalf("Failed to load the auth config: %s", err)
+		}
+		// The binary and RESP protocols have no way to pass a token.
+		if *binaryPort != 0 || *respPort != 0 {
+			log.Fatal("The binary and RESP protocols cannot be used with authentication")
+		}
+		auth.audit = audit
+		handler = auth.middleware(handler)
+	}
+	if limiter != nil {
+		handler = limiter.middleware(handler)
+	}
+	handler = ns.middleware(handler)
+	server := httptools.CreateServer(*port, handler)
 	go server.Start()
 
+	store := protocolStore{Store: Db, repl: repl, cl: cl}
+	var binaryServer *dbproto.Server
+	if *binaryPort != 0 {
+		binaryServer, err = startBinaryServer(*binaryPort, store, 2*storeConfig.MaxValueSize+storeConfig.MaxKeySize+maxBodyOverhead)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var respServer *dbresp.Server
+	if *respPort != 0 {
+		respServer, err = startRespServer(*respPort, store, storeConfig.MaxValueSize+storeConfig.MaxKeySize)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	signal.WaitForTerminationSignal()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	close(shutdown)
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down the HTTP server: %s", err)
+	}
+	if binaryServer != nil {
+		binaryServer.Close()
+	}
+	if respServer != nil {
+		respServer.Close()
+	}
+	if repl != nil {
+		repl.stop()
+	}
+	if err := ns.Close(); err != nil {
+		log.Printf("Failed to close the database: %s", err)
+	}
+	if audit != nil {
+		if err := audit.Close(); err != nil {
+			log.Printf("Failed to close the audit log: %s", err)
+		}
+	}
 }
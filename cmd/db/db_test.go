@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestPath(t *testing.T) {
+	ns := newTestNamespaces(t, newTestDb(t), "users")
+	cases := []struct {
+		target    string
+		namespace string
+		key       string
+		valid     bool
+	}{
+		{"/db/key", "default", "key", true},
+		{"/db/key?value=ignored", "default", "key", true},
+		{"/db/with%20space", "default", "with space", true},
+		{"/db/caf%C3%A9", "default", "café", true},
+		{"/db/users%2F1", "default", "users/1", true},
+		{"/db/a%2F%2Fb", "default", "a//b", true},
+		{"/db/100%25", "default", "100%", true},
+		{"/db/users/1/name", "users", "1/name", true},
+		{"/db/users/a%2Fb", "users", "a/b", true},
+		{"/db/default/key", "default", "key", true},
+		{"/db/default/users/1", "default", "users/1", true},
+		{"/db/other/1/name", "default", "other/1/name", true},
+		{"/db/a//b/./c", "default", "a//b/./c", true},
+		{"/db/_users/key", "default", "_users/key", true},
+		{"/db//key", "default", "/key", true},
+		{"/db/_mget", "default", "_mget", true},
+		{"/db/users/_mget", "users", "_mget", true},
+		{"/db/other/_mget", "other", "_mget", true},
+		{"/db/", "", "", false},
+		{"/db/?key=value", "", "", false},
+		{"/db/users/", "", "", false},
+		{"/db/_users/_mget", "", "", false},
+		{"/db//_mget", "", "", false},
+		{"/other/key", "", "", false},
+	}
+	for _, tc := range cases {
+		namespace, key, err := resolvePath(httptest.NewRequest("GET", tc.target, nil), ns.exists)
+		if tc.valid {
+			assert.NoError(t, err, tc.target)
+			assert.Equal(t, tc.namespace, namespace, tc.target)
+			assert.Equal(t, tc.key, key, tc.target)
+		} else {
+			assert.Error(t, err, tc.target)
+		}
+	}
+
+	// Without the middleware, only the default namespace is known.
+	namespace, key, err := requestPath(httptest.NewRequest("GET", "/db/users/1", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "default", namespace)
+	assert.Equal(t, "users/1", key)
+}
+
+func TestDbHandler(t *testing.T) {
+	handler := newHandler(newTestNamespaces(t, newTestDb(t), "ns"), nil, nil, nil, nil)
+
+	cases := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		status   int
+		response *RespBody
+	}{
+		{"get missing key", "GET", "/db/key", "", http.StatusNotFound, nil},
+		{"put key", "POST", "/db/key", `{"value":"v1"}`, http.StatusCreated, nil},
+		{"get key", "GET", "/db/key", "", http.StatusOK, &RespBody{"key", "v1"}},
+		{"ignore query string", "GET", "/db/key?x=1", "", http.StatusOK, &RespBody{"key", "v1"}},
+		{"put escaped key", "POST", "/db/a%20b", `{"value":"v2"}`, http.StatusCreated, nil},
+		{"get escaped key", "GET", "/db/a%20b", "", http.StatusOK, &RespBody{"a b", "v2"}},
+		{"put key with slashes", "POST", "/db/a//b/./c", `{"value":"v3"}`, http.StatusCreated, nil},
+		{"get key with slashes", "GET", "/db/a%2F%2Fb%2F.%2Fc", "", http.StatusOK, &RespBody{"a//b/./c", "v3"}},
+		{"put key in namespace", "POST", "/db/ns/a//b", `{"value":"v4"}`, http.StatusCreated, nil},
+		{"get key in namespace", "GET", "/db/ns/a//b", "", http.StatusOK, &RespBody{"a//b", "v4"}},
+		{"get key of other namespace", "GET", "/db/ns/key", "", http.StatusNotFound, nil},
+		{"put key under missing namespace", "POST", "/db/missing/key", `{"value":"v5"}`, http.StatusCreated, nil},
+		{"get key under missing namespace", "GET", "/db/default/missing/key", "", http.StatusOK, &RespBody{"missing/key", "v5"}},
+		{"batch in missing namespace", "POST", "/db/missing/_mput", `{"entries":[{"key":"k","value":"v"}]}`, http.StatusNotFound, nil},
+		{"batch in invalid namespace", "POST", "/db/_ns/_mget", `{"keys":["k"]}`, http.StatusBadRequest, nil},
+		{"put empty key", "POST", "/db/", `{"value":"v"}`, http.StatusBadRequest, nil},
+		{"get empty key", "GET", "/db/?key=key", "", http.StatusBadRequest, nil},
+		{"bad body", "POST", "/db/key", `{"value":`, http.StatusBadRequest, nil},
+		{"delete key", "DELETE", "/db/key", "", http.StatusOK, nil},
+		{"get deleted key", "GET", "/db/key", "", http.StatusNotFound, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			assert.Equal(t, tc.status, rw.Code)
+			if tc.response != nil {
+				var body RespBody
+				assert.NoError(t, json.NewDecoder(rw.Body).Decode(&body))
+				assert.Equal(t, *tc.response, body)
+			}
+		})
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	handler := newHandler(newTestNamespaces(t, newTestDb(t)), nil, nil, nil, nil)
+	post := func(target, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("POST", target, strings.NewReader(body)))
+		return rw
+	}
+
+	rw := post(mputPath, `{"entries":[{"key":"a","value":"1"},{"key":"b","value":"2"},{"key":"a","value":"3"}]}`)
+	assert.Equal(t, http.StatusCreated, rw.Code)
+
+	rw = post(mgetPath, `{"keys":["a","b","c","c"]}`)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	var resp MGetRespBody
+	assert.NoError(t, json.NewDecoder(rw.Body).Decode(&resp))
+	assert.Equal(t, map[string]string{"a": "3", "b": "2"}, resp.Values)
+	assert.Equal(t, []string{"c"}, resp.Missing)
+
+	assert.Equal(t, http.StatusBadRequest, post(mgetPath, `{"keys":["a",""]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, post(mputPath, `{"entries":`).Code)
+	tooMany := `{"keys":["k"` + strings.Repeat(`,"k"`, maxBatchKeys) + `]}`
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(mgetPath, tooMany).Code)
+	value := strings.Repeat("v", storeConfig.MaxValueSize+1)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(mputPath, `{"entries":[{"key":"x","value":"`+value+`"}]}`).Code)
+}
+
+func TestDbHandler_Metadata(t *testing.T) {
+	handler := newHandler(newTestNamespaces(t, newTestDb(t)), nil, nil, nil, nil)
+	do := func(method, target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(`{"value":"value"}`))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, http.StatusNotFound, do("HEAD", "/db/key", nil).Code)
+	assert.Equal(t, http.StatusCreated, do("POST", "/db/key", nil).Code)
+
+	get := do("GET", "/db/key", nil)
+	head := do("HEAD", "/db/key", nil)
+	assert.Equal(t, http.StatusOK, head.Code)
+	assert.Empty(t, head.Body.String())
+	assert.Equal(t, strconv.Itoa(get.Body.Len()), head.Header().Get("Content-Length"))
+	assert.Equal(t, "5", head.Header().Get(valueSizeHeader))
+	etag := get.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+	assert.Equal(t, etag, head.Header().Get("ETag"))
+	modified, err := http.ParseTime(get.Header().Get("Last-Modified"))
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), modified, time.Minute)
+
+	for _, match := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		rw := do("GET", "/db/key", http.Header{"If-None-Match": {match}})
+		assert.Equal(t, http.StatusNotModified, rw.Code, match)
+		assert.Empty(t, rw.Body.String())
+	}
+
+	assert.Equal(t, http.StatusCreated, do("POST", "/db/key", nil).Code)
+	rw := do("GET", "/db/key", http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.NotEqual(t, etag, rw.Header().Get("ETag"))
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+)
+
+// ErrorRespBody is the body of every error response. Code tells errors with
+// the same status apart, Key is the key the error is about, if any.
+type ErrorRespBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Key     string `json:"key,omitempty"`
+}
+
+const (
+	codeBadRequest       = "bad_request"
+	codeInvalidJSON      = "invalid_json"
+	codeBodyTooLarge     = "body_too_large"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeRateLimited      = "rate_limited"
+	codeMisdirected      = "misdirected"
+	codeForwardFailed    = "forward_failed"
+	codeNotEnabled       = "not_enabled"
+	codeInternal         = "internal"
+)
+
+var (
+	errInvalidPath = errors.New("invalid path")
+	errNoEndpoint  = errors.New("no such endpoint")
+	errNoCluster   = errors.New("the server is not a cluster member")
+	errNoReplica   = errors.New("the server is not a replica")
+)
+
+// statusError is an error answered with its own status and code.
+type statusError struct {
+	status int
+	code   string
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &statusError{status: http.StatusBadRequest, code: codeBadRequest, err: fmt.Errorf(format, args...)}
+}
+
+// errorStatuses maps the errors of the datastore and of the service to the
+// statuses and codes of the responses. Errors wrapping them map the same way;
+// the first match wins, so more specific errors come first.
+var errorStatuses = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{datastore.ErrNotFound, http.StatusNotFound, "not_found"},
+	{datastore.ErrKeyTooLarge, http.StatusRequestEntityTooLarge, "key_too_large"},
+	{datastore.ErrValueTooLarge, http.StatusRequestEntityTooLarge, "value_too_large"},
+	{errReplica, http.StatusServiceUnavailable, "replica"},
+	{datastore.ErrReadOnly, http.StatusServiceUnavailable, "read_only"},
+	{datastore.ErrClosed, http.StatusServiceUnavailable, "closed"},
+	{datastore.ErrCorrupted, http.StatusInternalServerError, "corrupted"},
+	{datastore.ErrUnknownKey, http.StatusInternalServerError, "unknown_encryption_key"},
+	{datastore.ErrHistoryLost, http.StatusGone, "history_lost"},
+	{datastore.ErrMalformedExport, http.StatusBadRequest, "malformed_export"},
+	{bufio.ErrTooLong, http.StatusRequestEntityTooLarge, "line_too_long"},
+	{context.Canceled, http.StatusServiceUnavailable, "canceled"},
+	{context.DeadlineExceeded, http.StatusServiceUnavailable, "timeout"},
+	{errInvalidPath, http.StatusBadRequest, "invalid_path"},
+	{errNoEndpoint, http.StatusNotFound, "no_endpoint"},
+	{errEmptyKey, http.StatusBadRequest, "empty_key"},
+	{errTooManyKeys, http.StatusRequestEntityTooLarge, "too_many_keys"},
+	{errInvalidNamespace, http.StatusBadRequest, "invalid_namespace"},
+	{errNamespaceNotFound, http.StatusNotFound, "namespace_not_found"},
+	{errDropDefault, http.StatusBadRequest, "default_namespace"},
+	{errAuditDisabled, http.StatusNotFound, codeNotEnabled},
+	{errNoCluster, http.StatusNotFound, codeNotEnabled},
+	{errNoReplica, http.StatusNotFound, codeNotEnabled},
+	{errAuditWrite, http.StatusServiceUnavailable, "audit_failed"},
+}
+
+// errorStatus returns the status and the code of the response to err. Errors
+// not known here are internal errors.
+func errorStatus(err error) (int, string) {
+	var (
+		statusErr   *statusError
+		fwdErr      *forwardError
+		maxBytesErr *http.MaxBytesError
+	)
+	switch {
+	case errors.As(err, &statusErr):
+		return statusErr.status, statusErr.code
+	case errors.As(err, &fwdErr):
+		return fwdErr.status, fwdErr.code
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge, codeBodyTooLarge
+	}
+	for _, e := range errorStatuses {
+		if errors.Is(err, e.err) {
+			return e.status, e.code
+		}
+	}
+	return http.StatusInternalServerError, codeInternal
+}
+
+// writeError answers a request with the status and the code of err. key is
+// the key the error is about, or empty.
+func writeError(rw http.ResponseWriter, key string, err error) {
+	status, code := errorStatus(err)
+	writeJSON(rw, status, ErrorRespBody{Code: code, Message: err.Error(), Key: key})
+}
+
+// allowMethods reports whether the method of the request is one of methods.
+// If it is not, the request is answered with 405 and the methods in Allow.
+func allowMethods(rw http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	allowed := strings.Join(methods, ", ")
+	rw.Header().Set("Allow", allowed)
+	writeError(rw, "", &statusError{
+		status: http.StatusMethodNotAllowed,
+		code:   codeMethodNotAllowed,
+		err:    fmt.Errorf("method %s is not allowed, use %s", req.Method, allowed),
+	})
+	return false
+}
+
+// decodeBody reads a JSON request body of at most limit bytes into body.
+func decodeBody(rw http.ResponseWriter, req *http.Request, limit int64, body interface{}) error {
+	err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, limit)).Decode(body)
+	var maxBytesErr *http.MaxBytesError
+	if err != nil && !errors.As(err, &maxBytesErr) {
+		return &statusError{status: http.StatusBadRequest, code: codeInvalidJSON, err: fmt.Errorf("invalid JSON body: %w", err)}
+	}
+	return err
+}
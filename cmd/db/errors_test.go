@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorStatus(t *testing.T) {
+	cases := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{datastore.ErrNotFound, http.StatusNotFound, "not_found"},
+		{fmt.Errorf("shard 2: %w", datastore.ErrValueTooLarge), http.StatusRequestEntityTooLarge, "value_too_large"},
+		{errReplica, http.StatusServiceUnavailable, "replica"},
+		{datastore.ErrReadOnly, http.StatusServiceUnavailable, "read_only"},
+		{context.DeadlineExceeded, http.StatusServiceUnavailable, "timeout"},
+		{datastore.ErrCorrupted, http.StatusInternalServerError, "corrupted"},
+		{&http.MaxBytesError{Limit: 1}, http.StatusRequestEntityTooLarge, codeBodyTooLarge},
+		{&forwardError{node: "2", status: http.StatusServiceUnavailable, code: "read_only"}, http.StatusServiceUnavailable, "read_only"},
+		{badRequest("bad"), http.StatusBadRequest, codeBadRequest},
+		{errors.New("disk on fire"), http.StatusInternalServerError, codeInternal},
+	}
+	for _, tc := range cases {
+		status, code := errorStatus(tc.err)
+		assert.Equal(t, tc.status, status, tc.err.Error())
+		assert.Equal(t, tc.code, code, tc.err.Error())
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	Db := newTestDb(t)
+	handler := newHandler(newTestNamespaces(t, Db), nil, nil, nil, nil)
+
+	cases := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+		code   string
+		key    string
+		allow  string
+	}{
+		{"missing key", "GET", "/db/missing", "", http.StatusNotFound, "not_found", "missing", ""},
+		{"missing namespace", "POST", "/db/users/_mget", `{"keys":["k"]}`, http.StatusNotFound, "namespace_not_found", "", ""},
+		{"bad JSON", "POST", "/db/key", `{"value":`, http.StatusBadRequest, codeInvalidJSON, "key", ""},
+		{"value too large", "POST", "/db/key", `{"value":"` + strings.Repeat("v", storeConfig.MaxValueSize+1) + `"}`, http.StatusRequestEntityTooLarge, "value_too_large", "key", ""},
+		{"invalid namespace", "POST", "/db/_ns/_mput", `{"entries":[]}`, http.StatusBadRequest, "invalid_namespace", "", ""},
+		{"empty key in batch", "POST", mgetPath, `{"keys":[""]}`, http.StatusBadRequest, "empty_key", "", ""},
+		{"unsupported method", "PUT", "/db/key", `{"value":"v"}`, http.StatusMethodNotAllowed, codeMethodNotAllowed, "", "GET, HEAD, POST, DELETE"},
+		{"batch with GET", "GET", mputPath, "", http.StatusMethodNotAllowed, codeMethodNotAllowed, "", "POST"},
+		{"watch with POST", "POST", "/db/_watch", "", http.StatusMethodNotAllowed, codeMethodNotAllowed, "", "GET"},
+		{"health with POST", "POST", "/health", "", http.StatusMethodNotAllowed, codeMethodNotAllowed, "", "GET, HEAD"},
+		{"import with GET", "GET", "/admin/import", "", http.StatusMethodNotAllowed, codeMethodNotAllowed, "", "POST"},
+		{"drop all namespaces", "DELETE", "/admin/namespaces", "", http.StatusMethodNotAllowed, codeMethodNotAllowed, "", "GET, POST"},
+		{"drop default namespace", "DELETE", "/admin/namespaces/default", "", http.StatusBadRequest, "default_namespace", "", ""},
+		{"promote without replication", "POST", "/replication/promote", "", http.StatusNotFound, codeNotEnabled, "", ""},
+		{"unknown endpoint", "GET", "/admin/unknown", "", http.StatusNotFound, "no_endpoint", "", ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body)))
+			assert.Equal(t, tc.status, rw.Code)
+			assert.Equal(t, "application/json", rw.Header().Get("content-type"))
+			assert.Equal(t, tc.allow, rw.Header().Get("Allow"))
+			var body ErrorRespBody
+			assert.NoError(t, json.NewDecoder(rw.Body).Decode(&body))
+			assert.Equal(t, tc.code, body.Code)
+			assert.Equal(t, tc.key, body.Key)
+			assert.NotEmpty(t, body.Message)
+		})
+	}
+
+	t.Run("HEAD", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("HEAD", "/db/missing", nil))
+		assert.Equal(t, http.StatusNotFound, rw.Code)
+		assert.Empty(t, rw.Body.String())
+	})
+
+	t.Run("replica", func(t *testing.T) {
+		ns := newTestNamespaces(t, Db)
+		repl := newReplicator("http://primary", ns)
+		handler := newHandler(ns, repl, nil, nil, nil)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("DELETE", "/db/key", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+		var body ErrorRespBody
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(&body))
+		assert.Equal(t, "replica", body.Code)
+		assert.Equal(t, "key", body.Key)
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+)
+
+type ImportRespBody struct {
+	Imported int `json:"imported"`
+}
+
+// requestNamespace returns the namespace given in the query, the default one
+// if there is none.
+func requestNamespace(req *http.Request) string {
+	if namespace := req.URL.Query().Get("namespace"); namespace != "" {
+		return namespace
+	}
+	return defaultNamespace
+}
+
+// handleExportRequest streams all live keys of a namespace as JSON Lines. In
+// a cluster only the keys stored on this node are exported.
+func handleExportRequest(ns *namespaces, rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, "GET") {
+		return
+	}
+	Db, err := ns.get(requestNamespace(req))
+	if err != nil {
+		writeError(rw, "", err)
+		return
+	}
+	rw.Header().Set("content-type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+	// The status is already sent, so a failed export can only be cut short.
+	if _, err := datastore.Export(req.Context(), rw, Db); err != nil {
+		log.Println("Error exporting the database: ", err)
+	}
+}
+
+// handleImportRequest writes the entries of an export into a namespace,
+// creating it if needed, in batches. In a
+// cluster every batch is split between the owners of its keys. An import is
+// not atomic: on error the response tells how many entries have been written.
+func handleImportRequest(ns *namespaces, repl *replicator, cl *cluster, rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, "POST") {
+		return
+	}
+	if repl != nil && !repl.acceptsWrites() {
+		writeError(rw, "", errReplica)
+		return
+	}
+
+	namespace := requestNamespace(req)
+	Db, _, err := ns.create(namespace)
+	if err != nil {
+		writeError(rw, "", err)
+		return
+	}
+	mput := dbPathPrefix + url.PathEscape(namespace) + "/" + mputName
+
+	maxLineSize := 2*storeConfig.MaxValueSize + storeConfig.MaxKeySize + maxBodyOverhead
+	n, err := datastore.Import(req.Context(), req.Body, maxLineSize, func(ctx context.Context, entries []*datastore.Entry) error {
+		if err := waitWrites(ctx, len(entries)); err != nil {
+			return err
+		}
+		mutations := make([]mutation, len(entries))
+		for i, e := range entries {
+			mutations[i] = mutation{key: e.Key(), valueSize: len(e.Value())}
+		}
+		done, err := noteMutations(req, mutations)
+		if err != nil {
+			return err
+		}
+		err = putBatch(Db, cl, req, mput, entries)
+		done(err)
+		return err
+	})
+	if err != nil {
+		writeError(rw, "", fmt.Errorf("imported %d entries before the error: %w", n, err))
+		return
+	}
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(ImportRespBody{Imported: n}); err != nil {
+		log.Println("Error encoding response: ", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImport(t *testing.T) {
+	src, dst := newTestDb(t), newTestDb(t)
+	for i := 0; i < 150; i++ {
+		assert.NoError(t, src.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)))
+	}
+
+	rw := httptest.NewRecorder()
+	newHandler(newTestNamespaces(t, src), nil, nil, nil, nil).ServeHTTP(rw, httptest.NewRequest("GET", "/admin/export", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, 150, strings.Count(rw.Body.String(), "\n"))
+
+	handler := newHandler(newTestNamespaces(t, dst), nil, nil, nil, nil)
+	imported := httptest.NewRecorder()
+	handler.ServeHTTP(imported, httptest.NewRequest("POST", "/admin/import", rw.Body))
+	assert.Equal(t, http.StatusOK, imported.Code)
+	var body ImportRespBody
+	assert.NoError(t, json.NewDecoder(imported.Body).Decode(&body))
+	assert.Equal(t, 150, body.Imported)
+	value, err := dst.Get("key-42")
+	assert.NoError(t, err)
+	assert.Equal(t, "value-42", value)
+
+	t.Run("malformed line", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest("POST", "/admin/import", strings.NewReader("{\"key\":\"a\",\"value\":\"b\"}\nnot json\n")))
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+		assert.Contains(t, rw.Body.String(), "line 2")
+	})
+
+	t.Run("replica", func(t *testing.T) {
+		ns := newTestNamespaces(t, dst)
+		repl := newReplicator("http://127.0.0.1:0", ns)
+		rw := httptest.NewRecorder()
+		newHandler(ns, repl, nil, nil, nil).ServeHTTP(rw, httptest.NewRequest("POST", "/admin/import", strings.NewReader("")))
+		assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	})
+}
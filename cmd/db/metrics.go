@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+)
+
+// StatsRespBody is the statistics of the datastore, with those of the rate
+// limits if requests are limited.
+type StatsRespBody struct {
+	datastore.Stats
+	RateLimit *RateLimitStats `json:"rate_limit,omitempty"`
+}
+
+func handleStatsRequest(Db statsSource, limiter *rateLimiter, rw http.ResponseWriter) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(rw).Encode(StatsRespBody{Stats: Db.Stats(), RateLimit: limiter.Stats()}); err != nil {
+		log.Println("Error encoding response: ", err)
+	}
+}
+
+func handleMetricsRequest(Db statsSource, limiter *rateLimiter, rw http.ResponseWriter) {
+	rw.Header().Set("content-type", "text/plain; version=0.0.4")
+	rw.WriteHeader(http.StatusOK)
+	err := writeMetrics(rw, Db.Stats())
+	if st := limiter.Stats(); err == nil && st != nil {
+		err = writeRateLimitMetrics(rw, *st)
+	}
+	if err != nil {
+		log.Println("Error writing metrics: ", err)
+	}
+}
+
+// writeMetrics writes the statistics in the Prometheus text exposition format.
+func writeMetrics(w io.Writer, st datastore.Stats) error {
+	metrics := []struct {
+		name, help, kind string
+		value            float64
+	}{
+		{"datastore_segments", "Number of segment files.", "gauge", float64(st.Segments)},
+		{"datastore_disk_bytes", "Size of all segment files in bytes.", "gauge", float64(st.DiskBytes)},
+		{"datastore_live_keys", "Number of keys that are not deleted.", "gauge", float64(st.LiveKeys)},
+		{"datastore_live_bytes", "Size of the newest records of live keys in bytes.", "gauge", float64(st.LiveBytes)},
+		{"datastore_garbage_ratio", "Share of disk space taken by stale records.", "gauge", st.GarbageRatio},
+		{"datastore_index_memory_bytes", "Approximate memory used by the key index in bytes.", "gauge", float64(st.IndexMemoryBytes)},
+		{"datastore_compaction_runs_total", "Number of completed compactions.", "counter", float64(st.CompactionRuns)},
+	}
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.kind, m.name, m.value); err != nil {
+			return err
+		}
+	}
+
+	latencies := []struct {
+		name, help string
+		stats      datastore.LatencyStats
+	}{
+		{"datastore_put_duration_seconds", "Duration of put and delete operations.", st.Put},
+		{"datastore_get_duration_seconds", "Duration of get operations.", st.Get},
+	}
+	for _, l := range latencies {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s summary\n%s_sum %g\n%s_count %d\n",
+			l.name, l.help, l.name, l.name, l.stats.Total.Seconds(), l.name, l.stats.Count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeRateLimitMetrics(w io.Writer, st RateLimitStats) error {
+	metrics := []struct {
+		name, help, kind string
+		value            float64
+	}{
+		{"db_rate_limit_clients", "Number of clients with a rate limit bucket.", "gauge", float64(st.Clients)},
+		{"db_rate_limit_allowed_total", "Number of requests within the rate limits.", "counter", float64(st.Allowed)},
+		{"db_rate_limited_client_total", "Number of requests rejected by the rate limit of their client.", "counter", float64(st.LimitedClient)},
+		{"db_rate_limited_writes_total", "Number of writes rejected by the global write rate limit.", "counter", float64(st.LimitedWrites)},
+	}
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.kind, m.name, m.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
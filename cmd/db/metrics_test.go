@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	st := datastore.Stats{
+		Segments:       2,
+		DiskBytes:      300,
+		LiveKeys:       4,
+		LiveBytes:      150,
+		GarbageRatio:   0.5,
+		CompactionRuns: 3,
+		Put:            datastore.LatencyStats{Count: 10, Total: 2 * time.Second},
+	}
+	if err := writeMetrics(&buf, st); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(buf.String(), "\n")
+	assert.Contains(t, lines, "# TYPE datastore_segments gauge")
+	assert.Contains(t, lines, "datastore_segments 2")
+	assert.Contains(t, lines, "datastore_disk_bytes 300")
+	assert.Contains(t, lines, "datastore_garbage_ratio 0.5")
+	assert.Contains(t, lines, "# TYPE datastore_compaction_runs_total counter")
+	assert.Contains(t, lines, "datastore_compaction_runs_total 3")
+	assert.Contains(t, lines, "# TYPE datastore_put_duration_seconds summary")
+	assert.Contains(t, lines, "datastore_put_duration_seconds_sum 2")
+	assert.Contains(t, lines, "datastore_put_duration_seconds_count 10")
+	assert.Contains(t, lines, "datastore_get_duration_seconds_count 0")
+}
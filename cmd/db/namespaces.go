@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+	"github.com/NikitaSutulov/software-architecture-lab4/dbconfig"
+)
+
+const (
+	defaultNamespace    = dbconfig.DefaultNamespace
+	namespacesDir       = dbconfig.NamespacesDir
+	namespacesAdminPath = "/admin/namespaces"
+	// droppedPrefix starts the names the directories of dropped namespaces
+	// are renamed to until they are removed. Namespace names never start
+	// with '.'.
+	droppedPrefix = ".dropped-"
+)
+
+var (
+	errNamespaceNotFound = errors.New("namespace does not exist")
+	errInvalidNamespace  = errors.New("namespace names are 1 to 64 letters, digits, '-' or '_', not starting with '_' or '-'")
+	errDropDefault       = errors.New("the default namespace cannot be dropped")
+)
+
+var namespacePattern = dbconfig.NamespacePattern
+
+// namespaces are the named databases of the service. The default one is
+// stored in the data directory itself and always exists, the others are
+// created through /admin/namespaces and each stored in a directory of its own.
+type namespaces struct {
+	dir  string
+	open func(dir string) (Store, error)
+
+	mutex  sync.RWMutex
+	stores map[string]Store
+}
+
+// newNamespaces opens the namespaces left in dir by a previous run. open
+// opens the store of a namespace in the given directory, creating it if
+// needed.
+func newNamespaces(dir string, def Store, open func(dir string) (Store, error)) (*namespaces, error) {
+	n := &namespaces{
+		dir:    filepath.Join(dir, namespacesDir),
+		open:   open,
+		stores: map[string]Store{defaultNamespace: def},
+	}
+	entries, err := os.ReadDir(n.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), droppedPrefix) {
+			// The removal of a dropped namespace was interrupted.
+			if err := os.RemoveAll(filepath.Join(n.dir, entry.Name())); err != nil {
+				log.Printf("Failed to remove dropped namespace %s: %s", entry.Name(), err)
+			}
+			continue
+		}
+		if !entry.IsDir() || !namespacePattern.MatchString(entry.Name()) {
+			continue
+		}
+		store, err := open(filepath.Join(n.dir, entry.Name()))
+		if err != nil {
+			n.Close()
+			return nil, fmt.Errorf("failed to open namespace %s: %w", entry.Name(), err)
+		}
+		n.stores[entry.Name()] = store
+	}
+	return n, nil
+}
+
+// get returns the store of an existing namespace.
+func (n *namespaces) get(name string) (Store, error) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	store, ok := n.stores[name]
+	if !ok {
+		return nil, errNamespaceNotFound
+	}
+	return store, nil
+}
+
+func (n *namespaces) exists(name string) bool {
+	_, err := n.get(name)
+	return err == nil
+}
+
+// create returns the store of a namespace, creating the namespace if it does
+// not exist. It reports whether the namespace has been created.
+func (n *namespaces) create(name string) (Store, bool, error) {
+	if store, err := n.get(name); err == nil {
+		return store, false, nil
+	}
+	if !namespacePattern.MatchString(name) {
+		return nil, false, errInvalidNamespace
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if store, ok := n.stores[name]; ok {
+		return store, false, nil
+	}
+	dir := filepath.Join(n.dir, name)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, false, err
+	}
+	store, err := n.open(dir)
+	if err != nil {
+		return nil, false, err
+	}
+	n.stores[name] = store
+	return store, true, nil
+}
+
+type requestPathKey struct{}
+
+type resolvedPath struct {
+	namespace, key string
+	err            error
+}
+
+// middleware resolves the namespace and the key of a request under /db/ once,
+// so the middlewares and the handler agree on them even if the namespace is
+// created or dropped in between.
+func (n *namespaces) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, dbPathPrefix) && req.Context().Value(requestPathKey{}) == nil {
+			p := &resolvedPath{}
+			p.namespace, p.key, p.err = resolvePath(req, n.exists)
+			req = req.WithContext(context.WithValue(req.Context(), requestPathKey{}, p))
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// drop closes a namespace and deletes its data. Requests still using the
+// store fail with datastore.ErrClosed. The directory of the namespace is
+// renamed before the lock is released, so a namespace created with the same
+// name right away gets a new directory rather than one being removed.
+func (n *namespaces) drop(name string) error {
+	if name == defaultNamespace {
+		return errDropDefault
+	}
+	n.mutex.Lock()
+	store, ok := n.stores[name]
+	if !ok {
+		n.mutex.Unlock()
+		return errNamespaceNotFound
+	}
+	dropped := filepath.Join(n.dir, fmt.Sprintf("%s%s-%d", droppedPrefix, name, time.Now().UnixNano()))
+	if err := os.Rename(filepath.Join(n.dir, name), dropped); err != nil {
+		n.mutex.Unlock()
+		return err
+	}
+	delete(n.stores, name)
+	n.mutex.Unlock()
+
+	if err := store.Close(); err != nil {
+		log.Printf("Failed to close namespace %s: %s", name, err)
+	}
+	return os.RemoveAll(dropped)
+}
+
+func (n *namespaces) names() []string {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	names := make([]string, 0, len(n.stores))
+	for name := range n.stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Stats returns the statistics of all namespaces combined.
+func (n *namespaces) Stats() datastore.Stats {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	stats := make([]datastore.Stats, 0, len(n.stores))
+	for _, store := range n.stores {
+		stats = append(stats, store.Stats())
+	}
+	return datastore.MergeStats(stats...)
+}
+
+// Degraded returns the write error of the default namespace or, if there is
+// none, of any other namespace.
+func (n *namespaces) Degraded() error {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	if err := n.stores[defaultNamespace].Degraded(); err != nil {
+		return err
+	}
+	for name, store := range n.stores {
+		if err := store.Degraded(); err != nil {
+			return fmt.Errorf("namespace %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (n *namespaces) Close() error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	var errs []error
+	for _, store := range n.stores {
+		errs = append(errs, store.Close())
+	}
+	return errors.Join(errs...)
+}
+
+type NamespaceInfo struct {
+	Name  string          `json:"name"`
+	Stats datastore.Stats `json:"stats"`
+}
+
+type NamespaceReqBody struct {
+	Name string `json:"name"`
+}
+
+// handleNamespacesRequest lists namespaces with their statistics, creates
+// them and drops them. In a cluster, the node receiving a creation or a drop
+// passes it on to the other nodes, as every node holds a part of every
+// namespace; a failed node is caught up by repeating the request. A replica
+// follows the namespaces of its primary.
+func handleNamespacesRequest(ns *namespaces, repl *replicator, cl *cluster, rw http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, namespacesAdminPath), "/")
+	methods := []string{"GET", "POST"}
+	if name != "" {
+		methods = []string{"GET", "DELETE"}
+	}
+	if !allowMethods(rw, req, methods...) {
+		return
+	}
+	if req.Method != "GET" && repl != nil && !repl.acceptsWrites() {
+		writeError(rw, "", errReplica)
+		return
+	}
+
+	switch {
+	case req.Method == "GET" && name == "":
+		var infos []NamespaceInfo
+		for _, name := range ns.names() {
+			if store, err := ns.get(name); err == nil {
+				infos = append(infos, NamespaceInfo{Name: name, Stats: store.Stats()})
+			}
+		}
+		writeJSON(rw, http.StatusOK, infos)
+	case req.Method == "GET":
+		store, err := ns.get(name)
+		if err != nil {
+			writeError(rw, "", err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, NamespaceInfo{Name: name, Stats: store.Stats()})
+	case req.Method == "POST":
+		var body NamespaceReqBody
+		if err := decodeBody(rw, req, maxBodyOverhead, &body); err != nil {
+			writeError(rw, "", err)
+			return
+		}
+		done, err := noteNamespaceChange(req, body.Name)
+		if err != nil {
+			writeError(rw, "", err)
+			return
+		}
+		store, created, err := ns.create(body.Name)
+		if err == nil && cl != nil {
+			err = cl.broadcast(req, "POST", namespacesAdminPath, body, false)
+		}
+		done(err)
+		if err != nil {
+			writeError(rw, "", err)
+			return
+		}
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		writeJSON(rw, status, NamespaceInfo{Name: body.Name, Stats: store.Stats()})
+	default:
+		done, err := noteNamespaceChange(req, name)
+		if err != nil {
+			writeError(rw, "", err)
+			return
+		}
+		// The other nodes drop the namespace first, so that the request can
+		// be repeated until all of them have.
+		if cl != nil {
+			err = cl.broadcast(req, "DELETE", namespacesAdminPath+"/"+name, nil, true)
+		}
+		if err == nil {
+			err = ns.drop(name)
+		}
+		done(err)
+		if err != nil {
+			writeError(rw, "", err)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, status int, body interface{}) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(body); err != nil {
+		log.Println("Error encoding response: ", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespaces(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-namespaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	open := func(dir string) (Store, error) {
+		return datastore.NewDb(dir, 1<<20)
+	}
+	Db, err := open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := newNamespaces(dir, Db, open)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newHandler(ns, nil, nil, nil, nil)
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rw
+	}
+
+	assert.Equal(t, http.StatusCreated, do("POST", "/admin/namespaces", `{"name":"orders"}`).Code)
+	assert.Equal(t, http.StatusOK, do("POST", "/admin/namespaces", `{"name":"orders"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/admin/namespaces", `{"name":"_orders"}`).Code)
+
+	// Writes do not create namespaces: before users exists, the path is a key
+	// of the default namespace.
+	assert.Equal(t, http.StatusNotFound, do("POST", "/db/users/_mput", `{"entries":[{"key":"1","value":"v"}]}`).Code)
+	assert.Equal(t, http.StatusCreated, do("POST", "/db/users/1", `{"value":"legacy"}`).Code)
+	assert.Equal(t, http.StatusCreated, do("POST", "/admin/namespaces", `{"name":"users"}`).Code)
+
+	assert.Equal(t, http.StatusCreated, do("POST", "/db/users/1", `{"value":"alice"}`).Code)
+	assert.Equal(t, http.StatusCreated, do("POST", "/db/1", `{"value":"default"}`).Code)
+	assert.Equal(t, http.StatusCreated, do("POST", "/db/users/_mput", `{"entries":[{"key":"2","value":"bob"}]}`).Code)
+
+	rw := do("POST", "/db/users/_mget", `{"keys":["1","2","3"]}`)
+	var values MGetRespBody
+	assert.NoError(t, json.NewDecoder(rw.Body).Decode(&values))
+	assert.Equal(t, map[string]string{"1": "alice", "2": "bob"}, values.Values)
+	assert.Equal(t, http.StatusNotFound, do("POST", "/db/missing/_mget", `{"keys":["1"]}`).Code)
+	rw = do("GET", "/db/default/users/1", "")
+	var value RespBody
+	assert.NoError(t, json.NewDecoder(rw.Body).Decode(&value))
+	assert.Equal(t, RespBody{"users/1", "legacy"}, value)
+
+	rw = do("GET", "/admin/namespaces", "")
+	var infos []NamespaceInfo
+	assert.NoError(t, json.NewDecoder(rw.Body).Decode(&infos))
+	if assert.Len(t, infos, 3) {
+		assert.Equal(t, "default", infos[0].Name)
+		assert.Equal(t, int64(2), infos[0].Stats.LiveKeys)
+		assert.Equal(t, "orders", infos[1].Name)
+		assert.Equal(t, int64(0), infos[1].Stats.LiveKeys)
+		assert.Equal(t, "users", infos[2].Name)
+		assert.Equal(t, int64(2), infos[2].Stats.LiveKeys)
+	}
+	rw = do("GET", "/admin/stats", "")
+	var stats datastore.Stats
+	assert.NoError(t, json.NewDecoder(rw.Body).Decode(&stats))
+	assert.Equal(t, int64(4), stats.LiveKeys)
+
+	t.Run("reopen", func(t *testing.T) {
+		assert.NoError(t, ns.Close())
+		Db, err := open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ns, err = newNamespaces(dir, Db, open)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler = newHandler(ns, nil, nil, nil, nil)
+		assert.Equal(t, []string{"default", "orders", "users"}, ns.names())
+		assert.Equal(t, http.StatusOK, do("GET", "/db/users/1", "").Code)
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, do("DELETE", "/admin/namespaces/default", "").Code)
+		assert.Equal(t, http.StatusOK, do("DELETE", "/admin/namespaces/users", "").Code)
+		assert.Equal(t, http.StatusNotFound, do("DELETE", "/admin/namespaces/users", "").Code)
+		assert.Equal(t, http.StatusNotFound, do("GET", "/admin/namespaces/users", "").Code)
+		assert.Equal(t, http.StatusNotFound, do("POST", "/db/users/_mget", `{"keys":["1"]}`).Code)
+		rw := do("GET", "/db/users/1", "")
+		var value RespBody
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(&value))
+		assert.Equal(t, RespBody{"users/1", "legacy"}, value, "the path is a key of the default namespace again")
+		assert.Equal(t, http.StatusOK, do("GET", "/db/1", "").Code)
+		assert.NoDirExists(t, dir+"/namespaces/users")
+		entries, err := os.ReadDir(dir + "/namespaces")
+		assert.NoError(t, err)
+		for _, entry := range entries {
+			assert.NotContains(t, entry.Name(), droppedPrefix, "the dropped directory is removed")
+		}
+	})
+
+	t.Run("drop while creating", func(t *testing.T) {
+		// A namespace created again as soon as it is dropped must keep its
+		// data, even though the old directory is still being removed.
+		for i := 0; i < 20; i++ {
+			store, _, err := ns.create("orders")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.NoError(t, store.PutContext(context.Background(), "key", "value"))
+			done := make(chan error)
+			go func() { done <- ns.drop("orders") }()
+			for {
+				store, _, err = ns.create("orders")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := store.GetContext(context.Background(), "key"); err == datastore.ErrNotFound {
+					break
+				}
+			}
+			assert.NoError(t, store.PutContext(context.Background(), "new", "value"))
+			assert.NoError(t, <-done)
+			value, err := store.GetContext(context.Background(), "new")
+			assert.NoError(t, err)
+			assert.Equal(t, "value", value)
+			assert.NoError(t, ns.drop("orders"))
+		}
+	})
+	assert.NoError(t, ns.Close())
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/dbproto"
+	"github.com/NikitaSutulov/software-architecture-lab4/dbresp"
+)
+
+// protocolStore applies the rules of the HTTP API to requests of the binary
+// and RESP protocols: replicas refuse writes and cluster nodes only serve
+// their keys.
+type protocolStore struct {
+	Store
+	repl *replicator
+	cl   *cluster
+}
+
+func (s protocolStore) check(key string, write bool) error {
+	if write && s.repl != nil && !s.repl.acceptsWrites() {
+		return errReplica
+	}
+	if s.cl != nil {
+		if owner := s.cl.owner(key); owner.ID != s.cl.self {
+			return fmt.Errorf("key is owned by node %s at %s", owner.ID, owner.URL)
+		}
+	}
+	return nil
+}
+
+func (s protocolStore) GetContext(ctx context.Context, key string) (string, error) {
+	if err := s.check(key, false); err != nil {
+		return "", err
+	}
+	return s.Store.GetContext(ctx, key)
+}
+
+func (s protocolStore) PutContext(ctx context.Context, key, value string) error {
+	if err := s.check(key, true); err != nil {
+		return err
+	}
+	return s.Store.PutContext(ctx, key, value)
+}
+
+func (s protocolStore) DeleteContext(ctx context.Context, key string) error {
+	if err := s.check(key, true); err != nil {
+		return err
+	}
+	return s.Store.DeleteContext(ctx, key)
+}
+
+// startBinaryServer listens for binary protocol clients on port.
+func startBinaryServer(port int, store dbproto.Store, maxFrameSize int) (*dbproto.Server, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	server := dbproto.NewServer(store, maxFrameSize)
+	go func() {
+		log.Printf("Starting the binary protocol server on port %d...", port)
+		if err := server.Serve(l); err != nil {
+			log.Fatalf("Binary protocol server finished: %s. Finishing the process.", err)
+		}
+	}()
+	return server, nil
+}
+
+// startRespServer listens for Redis clients on port.
+func startRespServer(port int, store dbresp.Store, maxBulkSize int) (*dbresp.Server, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	server := dbresp.NewServer(store, maxBulkSize)
+	go func() {
+		log.Printf("Starting the RESP server on port %d...", port)
+		if err := server.Serve(l); err != nil {
+			log.Fatalf("RESP server finished: %s. Finishing the process.", err)
+		}
+	}()
+	return server, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/dbclient"
+	"github.com/NikitaSutulov/software-architecture-lab4/dbproto"
+	"github.com/stretchr/testify/assert"
+)
+
+type testClient interface {
+	Get(key string) (string, error)
+	Put(key, value string) error
+}
+
+// startBothServers serves Db over HTTP and the binary protocol and returns a
+// client of each.
+func startBothServers(tb testing.TB, Db Store, repl *replicator) (httpClient, binaryClient testClient) {
+	tb.Helper()
+	server := httptest.NewServer(newHandler(newTestNamespaces(tb, Db), repl, nil, nil, nil))
+	tb.Cleanup(server.Close)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	binaryServer := dbproto.NewServer(protocolStore{Store: Db, repl: repl}, dbproto.DefaultMaxFrameSize)
+	go binaryServer.Serve(l)
+	tb.Cleanup(func() { binaryServer.Close() })
+
+	client, err := dbproto.Dial(l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { client.Close() })
+	return dbclient.New(server.URL), client
+}
+
+func TestBinaryProtocol(t *testing.T) {
+	Db := newTestDb(t)
+	httpClient, binaryClient := startBothServers(t, Db, nil)
+
+	assert.NoError(t, httpClient.Put("key", "from http"))
+	value, err := binaryClient.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "from http", value)
+
+	assert.NoError(t, binaryClient.Put("key", "from binary"))
+	value, err = httpClient.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "from binary", value)
+
+	t.Run("replica refuses writes", func(t *testing.T) {
+		replicaDb := newTestDb(t)
+		_, binaryClient := startBothServers(t, replicaDb, newReplicator("http://127.0.0.1:0", newTestNamespaces(t, replicaDb)))
+		err := binaryClient.Put("key", "value")
+		assert.ErrorIs(t, err, dbproto.ErrUnavailable)
+	})
+}
+
+// BenchmarkProtocols compares small-key reads and writes over HTTP with
+// JSON and over the binary protocol.
+func BenchmarkProtocols(b *testing.B) {
+	Db := newTestDb(b)
+	httpClient, binaryClient := startBothServers(b, Db, nil)
+	clients := []struct {
+		name   string
+		client testClient
+	}{{"http", httpClient}, {"binary", binaryClient}}
+
+	for _, c := range clients {
+		b.Run("put/"+c.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := c.client.Put(fmt.Sprintf("key-%d", i%1000), "value"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run("get/"+c.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := c.client.Get(fmt.Sprintf("key-%d", i%1000)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateSweepInterval is how often the buckets of clients that have been idle
+// long enough to refill are dropped.
+const rateSweepInterval = time.Minute
+
+// tokenBucket allows rate events per second on average and bursts of up to
+// burst events.
+type tokenBucket struct {
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// check reports whether n tokens can be taken from the bucket. If not, it
+// returns how long it takes for them to be added. Taking more tokens than the
+// burst needs a full bucket and leaves it in debt, so large batches are
+// allowed but still count at the rate.
+func (b *tokenBucket) check(now time.Time, n int) (bool, time.Duration) {
+	b.refill(now)
+	need := math.Min(float64(n), b.burst)
+	if b.tokens >= need {
+		return true, 0
+	}
+	return false, time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take removes n tokens from the bucket if check allows it.
+func (b *tokenBucket) take(now time.Time, n int) (bool, time.Duration) {
+	ok, wait := b.check(now, n)
+	if ok {
+		b.tokens -= float64(n)
+	}
+	return ok, wait
+}
+
+// RateLimitStats describes the limits and how often they have been hit.
+type RateLimitStats struct {
+	ClientRate    float64 `json:"client_rate"`
+	ClientBurst   int     `json:"client_burst"`
+	WriteRate     float64 `json:"write_rate"`
+	WriteBurst    int     `json:"write_burst"`
+	Clients       int     `json:"clients"`
+	Allowed       int64   `json:"allowed"`
+	LimitedClient int64   `json:"limited_client"`
+	LimitedWrites int64   `json:"limited_writes"`
+}
+
+// rateLimiter limits the requests of every client and the writes of all
+// clients together. Clients are told apart by the header, if it is set and
+// the request has it, or else by the remote address. A rate of 0 leaves the
+// requests unlimited.
+//
+// In a cluster, the node a client sends a request to limits it. Requests
+// forwarded by other nodes only count towards the write limit. The forwarding
+// header is trusted only on requests coming from a cluster member, as clients
+// can set it themselves.
+type rateLimiter struct {
+	header string
+	now    func() time.Time
+	// fromPeer reports whether a request comes from another node. It is nil
+	// unless the server is a cluster member.
+	fromPeer func(req *http.Request) bool
+
+	mutex     sync.Mutex
+	clients   map[string]*tokenBucket
+	writes    *tokenBucket
+	lastSweep time.Time
+	stats     RateLimitStats
+}
+
+func newRateLimiter(clientRate float64, clientBurst int, writeRate float64, writeBurst int, header string) (*rateLimiter, error) {
+	if clientRate < 0 || writeRate < 0 {
+		return nil, errors.New("rates cannot be negative")
+	}
+	if (clientRate > 0 && clientBurst < 1) || (writeRate > 0 && writeBurst < 1) {
+		return nil, errors.New("bursts must allow at least 1 request")
+	}
+	l := &rateLimiter{
+		header:  header,
+		now:     time.Now,
+		clients: make(map[string]*tokenBucket),
+		stats: RateLimitStats{
+			ClientRate:  clientRate,
+			ClientBurst: clientBurst,
+			WriteRate:   writeRate,
+			WriteBurst:  writeBurst,
+		},
+	}
+	l.lastSweep = l.now()
+	if writeRate > 0 {
+		l.writes = newTokenBucket(writeRate, writeBurst, l.lastSweep)
+	}
+	return l, nil
+}
+
+// client returns the name the requests of a client are limited by.
+func (l *rateLimiter) client(req *http.Request) string {
+	if l.header != "" {
+		if name := req.Header.Get(l.header); name != "" {
+			return name
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// allow takes the tokens of a request. If the request is over a limit, it
+// returns the time to wait before retrying and which limit has been hit. Both
+// limits are checked before any token is taken, so a request refused by one
+// does not use up the other.
+func (l *rateLimiter) allow(req *http.Request) (time.Duration, string) {
+	forwarded := req.Header.Get(forwardedHeader) != "" && l.fromPeer != nil && l.fromPeer(req)
+	client := l.client(req)
+	write := isWrite(req)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) >= rateSweepInterval {
+		l.sweep(now)
+	}
+	var b *tokenBucket
+	if l.stats.ClientRate > 0 && !forwarded {
+		var ok bool
+		if b, ok = l.clients[client]; !ok {
+			b = newTokenBucket(l.stats.ClientRate, l.stats.ClientBurst, now)
+			l.clients[client] = b
+		}
+		if ok, wait := b.check(now, 1); !ok {
+			l.stats.LimitedClient++
+			return wait, fmt.Sprintf("rate limit of %g requests per second exceeded by %s", l.stats.ClientRate, client)
+		}
+	}
+	if write {
+		if wait, reason := l.limitWrites(now, 1); reason != "" {
+			return wait, reason
+		}
+	}
+	if b != nil {
+		b.take(now, 1)
+	}
+	l.stats.Allowed++
+	return 0, ""
+}
+
+// takeWrites takes n write tokens. If there are not enough, it returns how
+// long it takes for them to be added. The caller must hold the mutex.
+func (l *rateLimiter) takeWrites(now time.Time, n int) (bool, time.Duration) {
+	if l.writes == nil {
+		return true, 0
+	}
+	return l.writes.take(now, n)
+}
+
+// limitWrites is like takeWrites, but counts writes over the limit and tells
+// which limit has been hit. The caller must hold the mutex.
+func (l *rateLimiter) limitWrites(now time.Time, n int) (time.Duration, string) {
+	if ok, wait := l.takeWrites(now, n); !ok {
+		l.stats.LimitedWrites++
+		return wait, fmt.Sprintf("rate limit of %g writes per second exceeded", l.stats.WriteRate)
+	}
+	return 0, ""
+}
+
+type rateLimiterKey struct{}
+
+// chargeWrites takes the write tokens of a batch of n entries. If the batch
+// is over the write limit, it sets Retry-After and returns the error to
+// answer the request with. It does nothing unless writes are limited.
+func chargeWrites(rw http.ResponseWriter, req *http.Request, n int) error {
+	l, ok := req.Context().Value(rateLimiterKey{}).(*rateLimiter)
+	if !ok {
+		return nil
+	}
+	l.mutex.Lock()
+	wait, reason := l.limitWrites(l.now(), n)
+	l.mutex.Unlock()
+	if reason == "" {
+		return nil
+	}
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return &statusError{status: http.StatusTooManyRequests, code: codeRateLimited, err: errors.New(reason)}
+}
+
+// waitWrites waits until the write tokens of a batch of n entries can be
+// taken, so long running imports are slowed down to the write rate instead
+// of failing halfway. Its waits are not counted as limited writes.
+func waitWrites(ctx context.Context, n int) error {
+	l, ok := ctx.Value(rateLimiterKey{}).(*rateLimiter)
+	if !ok {
+		return nil
+	}
+	for {
+		l.mutex.Lock()
+		ok, wait := l.takeWrites(l.now(), n)
+		l.mutex.Unlock()
+		if ok {
+			return nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// sweep drops the buckets that have refilled, which are the same as new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	for client, b := range l.clients {
+		if b.refill(now); b.tokens >= b.burst {
+			delete(l.clients, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Stats returns nil if requests are not limited.
+func (l *rateLimiter) Stats() *RateLimitStats {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	stats := l.stats
+	stats.Clients = len(l.clients)
+	return &stats
+}
+
+// isWrite reports whether a request writes a single key. Batches and imports
+// are charged per entry by their handlers.
+func isWrite(req *http.Request) bool {
+	if req.Method == "GET" || req.Method == "HEAD" || !strings.HasPrefix(req.URL.Path, dbPathPrefix) {
+		return false
+	}
+	_, key, err := requestPath(req)
+	return err == nil && !isReservedKey(key)
+}
+
+// middleware answers requests over a limit with 429 and the number of seconds
+// to wait in Retry-After. /health and /metrics are not limited.
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/health" || req.URL.Path == "/metrics" {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		if wait, reason := l.allow(req); reason != "" {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(rw, "", &statusError{status: http.StatusTooManyRequests, code: codeRateLimited, err: errors.New(reason)})
+			return
+		}
+		next.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), rateLimiterKey{}, l)))
+	})
+}
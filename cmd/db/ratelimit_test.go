@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 2, now)
+	for i := 0; i < 2; i++ {
+		ok, _ := b.take(now, 1)
+		assert.True(t, ok)
+	}
+	ok, wait := b.take(now, 1)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	now = now.Add(250 * time.Millisecond)
+	ok, wait = b.take(now, 1)
+	assert.False(t, ok)
+	assert.Equal(t, 250*time.Millisecond, wait)
+	now = now.Add(250 * time.Millisecond)
+	ok, _ = b.take(now, 1)
+	assert.True(t, ok)
+
+	now = now.Add(time.Hour)
+	b.refill(now)
+	assert.Equal(t, 2.0, b.tokens, "the bucket must not fill over its burst")
+
+	ok, _ = b.take(now, 3)
+	assert.True(t, ok, "a full bucket allows more than its burst")
+	assert.Equal(t, -1.0, b.tokens)
+	ok, wait = b.take(now, 1)
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, wait, "the debt is paid before the next token")
+}
+
+func TestRateLimiter(t *testing.T) {
+	_, err := newRateLimiter(-1, 1, 0, 0, "")
+	assert.Error(t, err)
+	_, err = newRateLimiter(1, 0, 0, 0, "")
+	assert.Error(t, err)
+
+	limiter, err := newRateLimiter(1, 2, 1, 3, "X-Client-Id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	handler := limiter.middleware(newHandler(newTestNamespaces(t, newTestDb(t)), nil, nil, nil, limiter))
+	do := func(client, method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if client != "" {
+			req.Header.Set("X-Client-Id", client)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, http.StatusNotFound, do("a", "GET", "/db/key", "").Code)
+	assert.Equal(t, http.StatusNotFound, do("a", "GET", "/db/key", "").Code)
+	rw := do("a", "GET", "/db/key", "")
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusNotFound, do("b", "GET", "/db/key", "").Code, "clients are limited separately")
+	assert.Equal(t, http.StatusNotFound, do("", "GET", "/db/key", "").Code, "the remote address is used without the header")
+	assert.Equal(t, http.StatusOK, do("a", "GET", "/health", "").Code)
+
+	forwarded := func(remote string) int {
+		req := httptest.NewRequest("GET", "/db/key", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("X-Client-Id", "a")
+		req.Header.Set(forwardedHeader, "node-2")
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	assert.Equal(t, http.StatusTooManyRequests, forwarded("10.0.0.2:41000"), "the forwarding header is not trusted outside a cluster")
+	limiter.fromPeer = func(req *http.Request) bool {
+		return strings.HasPrefix(req.RemoteAddr, "10.0.0.2:")
+	}
+	assert.Equal(t, http.StatusNotFound, forwarded("10.0.0.2:41000"), "forwarded requests are limited by the node the client sent them to")
+	assert.Equal(t, http.StatusTooManyRequests, forwarded("192.0.2.1:41000"), "clients cannot pass for other nodes")
+	limiter.fromPeer = nil
+
+	t.Run("writes", func(t *testing.T) {
+		for _, client := range []string{"c", "d", "e"} {
+			assert.Equal(t, http.StatusCreated, do(client, "POST", "/db/"+client, `{"value":"v"}`).Code)
+		}
+		rw := do("f", "POST", "/db/f", `{"value":"v"}`)
+		assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+		assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+		assert.Equal(t, http.StatusOK, do("f", "POST", "/db/_mget", `{"keys":["c"]}`).Code, "batch reads are not writes")
+		assert.Equal(t, http.StatusOK, do("f", "POST", "/db/_mget", `{"keys":["c"]}`).Code, "a write refused by the write limit does not use up the client limit")
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		rw := do("ops", "GET", "/admin/stats", "")
+		var stats StatsRespBody
+		assert.NoError(t, json.NewDecoder(rw.Body).Decode(&stats))
+		if assert.NotNil(t, stats.RateLimit) {
+			assert.Equal(t, 1.0, stats.RateLimit.ClientRate)
+			assert.Equal(t, 3, stats.RateLimit.WriteBurst)
+			assert.Equal(t, int64(3), stats.RateLimit.LimitedClient)
+			assert.Equal(t, int64(1), stats.RateLimit.LimitedWrites)
+			assert.Equal(t, 8, stats.RateLimit.Clients)
+		}
+		assert.Equal(t, int64(3), stats.LiveKeys)
+
+		rw = do("", "GET", "/metrics", "")
+		assert.Contains(t, strings.Split(rw.Body.String(), "\n"), "db_rate_limited_writes_total 1")
+	})
+
+	t.Run("refill", func(t *testing.T) {
+		now = now.Add(time.Second)
+		assert.Equal(t, http.StatusNotFound, do("a", "GET", "/db/key", "").Code)
+		assert.Equal(t, http.StatusCreated, do("f", "POST", "/db/f", `{"value":"v"}`).Code)
+
+		now = now.Add(2 * rateSweepInterval)
+		assert.Equal(t, http.StatusNotFound, do("a", "GET", "/db/key", "").Code)
+		assert.Equal(t, 1, limiter.Stats().Clients, "idle clients are forgotten")
+	})
+
+	t.Run("batches", func(t *testing.T) {
+		now = now.Add(3 * time.Second)
+		batch := func(client string, n int) *httptest.ResponseRecorder {
+			entries := make([]RespBody, n)
+			for i := range entries {
+				entries[i] = RespBody{Key: fmt.Sprintf("batch-%d", i), Value: "v"}
+			}
+			data, err := json.Marshal(MPutReqBody{Entries: entries})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return do(client, "POST", "/db/_mput", string(data))
+		}
+
+		assert.Equal(t, http.StatusCreated, batch("g", 2).Code)
+		rw := batch("h", 2)
+		assert.Equal(t, http.StatusTooManyRequests, rw.Code, "every entry of a batch is a write")
+		assert.Equal(t, "1", rw.Header().Get("Retry-After"))
+
+		now = now.Add(2 * time.Second)
+		assert.Equal(t, http.StatusCreated, batch("i", 5).Code, "a batch over the burst needs a full bucket")
+		rw = do("j", "POST", "/db/j", `{"value":"v"}`)
+		assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+		assert.Equal(t, "3", rw.Header().Get("Retry-After"))
+	})
+
+	t.Run("import", func(t *testing.T) {
+		ctx := context.WithValue(context.Background(), rateLimiterKey{}, limiter)
+		timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		assert.ErrorIs(t, waitWrites(timeoutCtx, 1), context.DeadlineExceeded, "imports wait for the write tokens")
+
+		now = now.Add(10 * time.Second)
+		assert.NoError(t, waitWrites(ctx, 1))
+	})
+}
+
+func TestRateLimiter_Disabled(t *testing.T) {
+	var limiter *rateLimiter
+	assert.Nil(t, limiter.Stats())
+
+	rw := httptest.NewRecorder()
+	newHandler(newTestNamespaces(t, newTestDb(t)), nil, nil, nil, nil).ServeHTTP(rw, httptest.NewRequest("GET", "/admin/stats", nil))
+	assert.NotContains(t, rw.Body.String(), "rate_limit")
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+)
+
+const (
+	replicationLogPath    = "/replication/log"
+	replicationHeartbeat  = time.Second
+	replicationRetryDelay = time.Second
+	replicationDiscovery  = 5 * time.Second
+)
+
+// Replication messages are sent by the primary as JSON lines. Positions in
+// the log are sequence numbers of the primary, as segment offsets change when
+// segments are compacted.
+const (
+	msgPut       = datastore.EventPut
+	msgDelete    = datastore.EventDelete
+	msgSnapshot  = "snapshot"
+	msgSynced    = "synced"
+	msgHeartbeat = "heartbeat"
+)
+
+var errReplica = fmt.Errorf("%w: writes are not accepted by a replica", datastore.ErrReadOnly)
+
+type replicationMessage struct {
+	Type  string `json:"type"`
+	Seq   uint64 `json:"seq"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// ReplicationStatus describes how far a replica is behind its primary. The
+// fields at the top level are those of the default namespace, Namespaces has
+// those of every namespace.
+type ReplicationStatus struct {
+	Primary string `json:"primary"`
+	NamespaceReplicationStatus
+	Namespaces map[string]NamespaceReplicationStatus `json:"namespaces"`
+}
+
+type NamespaceReplicationStatus struct {
+	Connected   bool      `json:"connected"`
+	AppliedSeq  uint64    `json:"applied_seq"`
+	PrimarySeq  uint64    `json:"primary_seq"`
+	LagRecords  uint64    `json:"lag_records"`
+	LastContact time.Time `json:"last_contact"`
+	LagSeconds  float64   `json:"lag_seconds"`
+}
+
+// handleReplicationLog streams the changes of the namespace given in the
+// namespace parameter, or of the default one, after the since sequence number
+// to a replica. A replica that is new, or too far behind for the changes to
+// be replayed, first receives a full copy of the live keys.
+func handleReplicationLog(ns *namespaces, rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, "GET") {
+		return
+	}
+	namespace := req.URL.Query().Get("namespace")
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	Db, err := ns.get(namespace)
+	if err != nil {
+		writeError(rw, "", err)
+		return
+	}
+	var (
+		since  uint64
+		events <-chan datastore.Event
+		stop   func()
+	)
+	if s := req.URL.Query().Get("since"); s != "" {
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			writeError(rw, "", badRequest("invalid sequence number %q", s))
+			return
+		}
+	}
+
+	snapshot := since == 0
+	if !snapshot {
+		events, stop, err = Db.WatchFrom("", since)
+		snapshot = errors.Is(err, datastore.ErrHistoryLost)
+	}
+	if snapshot {
+		// Subscribe before copying the keys, so no change made during the
+		// copy is missed.
+		since = Db.LastSeq()
+		events, stop, err = Db.WatchFrom("", since)
+	}
+	if err != nil {
+		writeError(rw, "", err)
+		return
+	}
+	defer stop()
+
+	rc := http.NewResponseController(rw)
+	_ = rc.SetWriteDeadline(time.Time{})
+	rw.Header().Set("content-type", "application/x-ndjson")
+	rw.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(rw)
+
+	if snapshot {
+		if err := sendSnapshot(req.Context(), Db, enc, since); err != nil {
+			log.Println("Error sending replication snapshot: ", err)
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var msg replicationMessage
+		select {
+		case e, ok := <-events:
+			if !ok {
+				// The replica fell behind; it reconnects and catches up.
+				return
+			}
+			msg = replicationMessage{Type: e.Type, Seq: e.Seq, Key: e.Key, Value: e.Value}
+		case <-heartbeat.C:
+			msg = replicationMessage{Type: msgHeartbeat, Seq: Db.LastSeq()}
+		case <-req.Context().Done():
+			return
+		case <-shutdown:
+			return
+		}
+		if err := enc.Encode(msg); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func sendSnapshot(ctx context.Context, Db Store, enc *json.Encoder, seq uint64) error {
+	keys, err := Db.Keys()
+	if err != nil {
+		return err
+	}
+	if err := enc.Encode(replicationMessage{Type: msgSnapshot, Seq: seq}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		value, err := Db.GetContext(ctx, key)
+		if err == datastore.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(replicationMessage{Type: msgPut, Seq: seq, Key: key, Value: value}); err != nil {
+			return err
+		}
+	}
+	return enc.Encode(replicationMessage{Type: msgSynced, Seq: seq})
+}
+
+// replicator follows the logs of the namespaces of a primary and applies
+// them to the local ones. Namespaces created on the primary are created
+// locally once they are discovered, those dropped there are dropped.
+type replicator struct {
+	primary string
+	ns      *namespaces
+	client  *http.Client
+	// token is sent to a primary that requires authentication.
+	token string
+	// discoveryInterval is how often the namespaces of the primary are listed.
+	discoveryInterval time.Duration
+
+	mutex     sync.Mutex
+	followers map[string]*follower
+	promoted  bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// follower replicates a single namespace. Its fields are guarded by the mutex
+// of the replicator.
+type follower struct {
+	db     Store
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	connected   bool
+	applied     uint64
+	primarySeq  uint64
+	lastContact time.Time
+}
+
+func newReplicator(primary string, ns *namespaces) *replicator {
+	return &replicator{
+		primary:           primary,
+		ns:                ns,
+		client:            &http.Client{},
+		discoveryInterval: replicationDiscovery,
+		followers:         make(map[string]*follower),
+		done:              make(chan struct{}),
+	}
+}
+
+// start follows the primary in the background until stop is called,
+// reconnecting after errors.
+func (r *replicator) start() {
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.mutex.Lock()
+	r.startFollower(defaultNamespace)
+	r.mutex.Unlock()
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.discoveryInterval)
+		defer ticker.Stop()
+		for {
+			if err := r.discover(r.ctx); err != nil && r.ctx.Err() == nil {
+				log.Printf("Failed to list the namespaces of %s: %v", r.primary, err)
+			}
+			select {
+			case <-ticker.C:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// startFollower starts following a namespace, creating it locally if needed.
+// It is called with the mutex held.
+func (r *replicator) startFollower(name string) {
+	if _, ok := r.followers[name]; ok || r.ctx.Err() != nil {
+		return
+	}
+	db, _, err := r.ns.create(name)
+	if err != nil {
+		log.Printf("Failed to create namespace %s to replicate: %v", name, err)
+		return
+	}
+	ctx, cancel := context.WithCancel(r.ctx)
+	f := &follower{db: db, cancel: cancel, done: make(chan struct{})}
+	r.followers[name] = f
+	go func() {
+		defer close(f.done)
+		for ctx.Err() == nil {
+			err := r.follow(ctx, name, f)
+			r.mutex.Lock()
+			f.connected = false
+			r.mutex.Unlock()
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Replication of namespace %s from %s interrupted: %v", name, r.primary, err)
+			select {
+			case <-time.After(replicationRetryDelay):
+			case <-ctx.Done():
+			}
+		}
+	}()
+}
+
+// discover follows the namespaces of the primary not followed yet and drops
+// the local namespaces the primary no longer has.
+func (r *replicator) discover(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", r.primary+namespacesAdminPath, nil)
+	if err != nil {
+		return err
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var infos []NamespaceInfo
+	if err := json.NewDecoder(resp.Body).Decode(&infos); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool, len(infos))
+	r.mutex.Lock()
+	for _, info := range infos {
+		names[info.Name] = true
+		r.startFollower(info.Name)
+	}
+	dropped := make(map[string]*follower)
+	for name, f := range r.followers {
+		if name != defaultNamespace && !names[name] {
+			dropped[name] = f
+			delete(r.followers, name)
+		}
+	}
+	r.mutex.Unlock()
+
+	for name, f := range dropped {
+		f.cancel()
+		<-f.done
+		if err := r.ns.drop(name); err != nil && err != errNamespaceNotFound {
+			log.Printf("Failed to drop namespace %s dropped by the primary: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// stop waits for the replication to stop. It may be called more than once.
+func (r *replicator) stop() {
+	r.cancel()
+	<-r.done
+	r.mutex.Lock()
+	followers := make([]*follower, 0, len(r.followers))
+	for _, f := range r.followers {
+		followers = append(followers, f)
+	}
+	r.mutex.Unlock()
+	for _, f := range followers {
+		<-f.done
+	}
+}
+
+// promote stops replication, so the replica starts accepting writes.
+func (r *replicator) promote() {
+	r.stop()
+	r.mutex.Lock()
+	r.promoted = true
+	r.mutex.Unlock()
+}
+
+// acceptsWrites reports whether the replica has been promoted to a primary.
+func (r *replicator) acceptsWrites() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.promoted
+}
+
+func (r *replicator) follow(ctx context.Context, name string, f *follower) error {
+	r.mutex.Lock()
+	since := f.applied
+	r.mutex.Unlock()
+
+	u := fmt.Sprintf("%s%s?namespace=%s&since=%d", r.primary, replicationLogPath, url.QueryEscape(name), since)
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	r.mutex.Lock()
+	f.connected = true
+	f.lastContact = time.Now()
+	r.mutex.Unlock()
+
+	// Keys present locally but missing from a snapshot were deleted on the
+	// primary while the replica was behind.
+	var stale map[string]struct{}
+
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var msg replicationMessage
+		if err := dec.Decode(&msg); err != nil {
+			return err
+		}
+
+		switch msg.Type {
+		case msgSnapshot:
+			keys, err := f.db.Keys()
+			if err != nil {
+				return err
+			}
+			stale = make(map[string]struct{}, len(keys))
+			for _, key := range keys {
+				stale[key] = struct{}{}
+			}
+		case msgPut:
+			delete(stale, msg.Key)
+			if err := f.db.PutContext(ctx, msg.Key, msg.Value); err != nil {
+				return err
+			}
+		case msgDelete:
+			if err := f.db.DeleteContext(ctx, msg.Key); err != nil {
+				return err
+			}
+		case msgSynced:
+			for key := range stale {
+				if err := f.db.DeleteContext(ctx, key); err != nil {
+					return err
+				}
+			}
+			stale = nil
+		}
+
+		r.mutex.Lock()
+		f.lastContact = time.Now()
+		if msg.Seq > f.primarySeq {
+			f.primarySeq = msg.Seq
+		}
+		// Snapshot records carry the position the snapshot was taken at,
+		// which counts as applied only once the snapshot is complete.
+		if stale == nil && msg.Type != msgHeartbeat {
+			f.applied = msg.Seq
+		}
+		r.mutex.Unlock()
+	}
+}
+
+func (r *replicator) status() ReplicationStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	st := ReplicationStatus{
+		Primary:    r.primary,
+		Namespaces: make(map[string]NamespaceReplicationStatus, len(r.followers)),
+	}
+	for name, f := range r.followers {
+		st.Namespaces[name] = f.status()
+	}
+	st.NamespaceReplicationStatus = st.Namespaces[defaultNamespace]
+	return st
+}
+
+// status is called with the mutex of the replicator held.
+func (f *follower) status() NamespaceReplicationStatus {
+	st := NamespaceReplicationStatus{
+		Connected:   f.connected,
+		AppliedSeq:  f.applied,
+		PrimarySeq:  f.primarySeq,
+		LastContact: f.lastContact,
+	}
+	if f.primarySeq > f.applied {
+		st.LagRecords = f.primarySeq - f.applied
+	}
+	if !f.lastContact.IsZero() && (st.LagRecords > 0 || !f.connected) {
+		st.LagSeconds = time.Since(f.lastContact).Seconds()
+	}
+	return st
+}
+
+func handleReplicationStatus(r *replicator, rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, "GET") {
+		return
+	}
+	if r == nil {
+		writeError(rw, "", errNoReplica)
+		return
+	}
+	writeJSON(rw, http.StatusOK, r.status())
+}
+
+func handlePromoteRequest(r *replicator, rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, "POST") {
+		return
+	}
+	if r == nil {
+		writeError(rw, "", errNoReplica)
+		return
+	}
+	if !r.acceptsWrites() {
+		r.promote()
+		log.Printf("Promoted to primary, stopped replicating from %s", r.primary)
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+func validPrimaryURL(primary string) error {
+	u, err := url.Parse(primary)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("primary must be an http(s) URL, got %q", primary)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore/sharded"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDb(t testing.TB) *datastore.Db {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := datastore.NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestNamespaces returns namespaces with Db as the default one and the
+// others created in a temporary directory.
+// newTestNamespaces returns namespaces with Db as the default one and creates
+// the named ones.
+func newTestNamespaces(t testing.TB, Db Store, names ...string) *namespaces {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "test-namespaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ns, err := newNamespaces(dir, Db, func(dir string) (Store, error) {
+		return datastore.NewDb(dir, 1<<20)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ns.Close() })
+	for _, name := range names {
+		if _, _, err := ns.create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ns
+}
+
+func TestReplication(t *testing.T) {
+	primaryDb := newTestDb(t)
+	replicaDb := newTestDb(t)
+
+	// Written before the replica connects, so it arrives with the snapshot.
+	assert.NoError(t, primaryDb.Put("before", "snapshot"))
+
+	primaryNs := newTestNamespaces(t, primaryDb)
+	primaryServer := httptest.NewServer(newHandler(primaryNs, nil, nil, nil, nil))
+	defer primaryServer.Close()
+
+	replicaNs := newTestNamespaces(t, replicaDb)
+	repl := newReplicator(primaryServer.URL, replicaNs)
+	repl.discoveryInterval = 10 * time.Millisecond
+	repl.start()
+	defer repl.stop()
+	replicaServer := httptest.NewServer(newHandler(replicaNs, repl, nil, nil, nil))
+	defer replicaServer.Close()
+
+	assert.Eventually(t, func() bool {
+		value, err := replicaDb.Get("before")
+		return err == nil && value == "snapshot"
+	}, 5*time.Second, 10*time.Millisecond, "snapshot was not replicated")
+
+	assert.NoError(t, primaryDb.Put("after", "stream"))
+	assert.NoError(t, primaryDb.Delete("before"))
+	assert.Eventually(t, func() bool {
+		_, err := replicaDb.Get("before")
+		value, _ := replicaDb.Get("after")
+		return err == datastore.ErrNotFound && value == "stream"
+	}, 5*time.Second, 10*time.Millisecond, "changes were not replicated")
+
+	t.Run("report lag", func(t *testing.T) {
+		assert.Eventually(t, func() bool {
+			st := repl.status()
+			return st.Connected && st.AppliedSeq == primaryDb.LastSeq() && st.LagRecords == 0
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("namespaces", func(t *testing.T) {
+		users, _, err := primaryNs.create("users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, users.PutContext(context.Background(), "1", "alice"))
+		assert.Eventually(t, func() bool {
+			replicaUsers, err := replicaNs.get("users")
+			if err != nil {
+				return false
+			}
+			value, err := replicaUsers.GetContext(context.Background(), "1")
+			return err == nil && value == "alice"
+		}, 5*time.Second, 10*time.Millisecond, "namespace was not replicated")
+		assert.Contains(t, repl.status().Namespaces, "users")
+
+		assert.NoError(t, primaryNs.drop("users"))
+		assert.Eventually(t, func() bool {
+			_, err := replicaNs.get("users")
+			return err == errNamespaceNotFound
+		}, 5*time.Second, 10*time.Millisecond, "namespace was not dropped")
+	})
+
+	t.Run("reject writes until promoted", func(t *testing.T) {
+		resp, err := http.Post(replicaServer.URL+"/db/key", "application/json", strings.NewReader(`{"value":"v"}`))
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		}
+
+		resp, err = http.Post(replicaServer.URL+"/replication/promote", "", nil)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+
+		resp, err = http.Post(replicaServer.URL+"/db/key", "application/json", strings.NewReader(`{"value":"v"}`))
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		}
+	})
+}
+
+func TestReplication_Sharded(t *testing.T) {
+	dir := t.TempDir()
+	primaryDb, err := sharded.NewDb(dir, sharded.ShardDirs(dir, 3), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primaryDb.Close()
+	replicaDb := newTestDb(t)
+
+	assert.NoError(t, primaryDb.Put("before", "snapshot"))
+	primaryServer := httptest.NewServer(newHandler(newTestNamespaces(t, primaryDb), nil, nil, nil, nil))
+	defer primaryServer.Close()
+
+	repl := newReplicator(primaryServer.URL, newTestNamespaces(t, replicaDb))
+	repl.start()
+	defer repl.stop()
+
+	assert.Eventually(t, func() bool {
+		value, err := replicaDb.Get("before")
+		return err == nil && value == "snapshot"
+	}, 5*time.Second, 10*time.Millisecond, "snapshot was not replicated")
+
+	// The keys are spread over all shards of the primary.
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, primaryDb.Put(fmt.Sprintf("key-%d", i), "stream"))
+	}
+	assert.Eventually(t, func() bool {
+		keys, err := replicaDb.Keys()
+		return err == nil && len(keys) == 11 && repl.status().AppliedSeq == primaryDb.LastSeq()
+	}, 5*time.Second, 10*time.Millisecond, "changes were not replicated")
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+	"github.com/NikitaSutulov/software-architecture-lab4/dbconfig"
+)
+
+// Store is the storage behind the db service: a single datastore.Db or a
+// sharded.Db.
+type Store = dbconfig.Store
+
+// statsSource is a store or all namespaces, which report their statistics
+// and write errors together.
+type statsSource interface {
+	Stats() datastore.Stats
+	Degraded() error
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+)
+
+const (
+	watchName         = "_watch"
+	watchPingInterval = 15 * time.Second
+)
+
+// shutdown is closed when the server stops, so that open watch streams end
+// and do not hold up the graceful shutdown.
+var shutdown = make(chan struct{})
+
+// handleWatchRequest streams changes of keys as server-sent events until done
+// is closed. Clients resume after a disconnect with the Last-Event-ID header
+// or the since query parameter.
+func handleWatchRequest(Db Store, done <-chan struct{}, rw http.ResponseWriter, req *http.Request) {
+	if !allowMethods(rw, req, "GET") {
+		return
+	}
+	prefix := req.URL.Query().Get("prefix")
+
+	since := req.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = req.URL.Query().Get("since")
+	}
+	var (
+		events <-chan datastore.Event
+		stop   func()
+	)
+	if since == "" {
+		events, stop = Db.Watch(prefix)
+	} else {
+		seq, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			writeError(rw, "", badRequest("invalid sequence number %q", since))
+			return
+		}
+		events, stop, err = Db.WatchFrom(prefix, seq)
+		if err != nil {
+			writeError(rw, "", err)
+			return
+		}
+	}
+	defer stop()
+
+	rc := http.NewResponseController(rw)
+	// The stream outlives any write timeout configured for the server.
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	rw.Header().Set("content-type", "text/event-stream")
+	rw.Header().Set("cache-control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		log.Println("Error flushing watch stream: ", err)
+		return
+	}
+
+	ping := time.NewTicker(watchPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				// The watcher fell behind or the database was closed.
+				return
+			}
+			if err := writeEvent(rw, e); err != nil {
+				return
+			}
+		case <-ping.C:
+			if _, err := fmt.Fprint(rw, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		case <-done:
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(rw http.ResponseWriter, e datastore.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Type, data)
+	return err
+}
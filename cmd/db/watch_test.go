@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+type sseEvent struct {
+	id, name string
+	data     datastore.Event
+}
+
+// readEvent reads the next event of a stream, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var e sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && e.id != "":
+			return e
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.data); err != nil {
+				t.Fatalf("invalid event data %q: %v", line, err)
+			}
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	Db, err := datastore.NewDb(dir, 1<<20, datastore.WithWatchHistory(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Db.Close()
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		handleWatchRequest(Db, done, rw, req)
+	}))
+	defer server.Close()
+
+	watch := func(query string, header http.Header) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("GET", server.URL+"/db/_watch"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := watch("?prefix=a/", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("content-type"))
+	assert.Equal(t, "no-cache", resp.Header.Get("cache-control"))
+	stream := bufio.NewReader(resp.Body)
+
+	assert.NoError(t, Db.Put("b/1", "skipped"))
+	assert.NoError(t, Db.Put("a/1", "first"))
+	assert.NoError(t, Db.Delete("a/1"))
+
+	e := readEvent(t, stream)
+	assert.Equal(t, "2", e.id, "the event of b/1 is filtered out")
+	assert.Equal(t, datastore.EventPut, e.name)
+	assert.Equal(t, datastore.Event{Seq: 2, Type: datastore.EventPut, Key: "a/1", Value: "first"}, e.data)
+	e = readEvent(t, stream)
+	assert.Equal(t, "3", e.id)
+	assert.Equal(t, datastore.EventDelete, e.name)
+	assert.Equal(t, "a/1", e.data.Key)
+
+	t.Run("resume with Last-Event-ID", func(t *testing.T) {
+		resp := watch("", http.Header{"Last-Event-ID": {"1"}})
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		stream := bufio.NewReader(resp.Body)
+		assert.Equal(t, "2", readEvent(t, stream).id)
+		assert.Equal(t, "3", readEvent(t, stream).id)
+	})
+
+	t.Run("resume with since", func(t *testing.T) {
+		stream := bufio.NewReader(watch("?since=2", nil).Body)
+		assert.Equal(t, "3", readEvent(t, stream).id)
+	})
+
+	t.Run("Last-Event-ID wins over since", func(t *testing.T) {
+		stream := bufio.NewReader(watch("?since=0", http.Header{"Last-Event-ID": {"2"}}).Body)
+		assert.Equal(t, "3", readEvent(t, stream).id)
+	})
+
+	t.Run("invalid sequence number", func(t *testing.T) {
+		resp := watch("?since=x", nil)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("history lost", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, Db.Put(fmt.Sprintf("c/%d", i), "v"))
+		}
+		// Only the last 3 events are kept, so the events after 1 are gone.
+		resp := watch("?since=1", nil)
+		assert.Equal(t, http.StatusGone, resp.StatusCode)
+		var body ErrorRespBody
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Equal(t, "history_lost", body.Code)
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		resp, err := http.Post(server.URL+"/db/_watch", "", nil)
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+			assert.Equal(t, "GET", resp.Header.Get("Allow"))
+		}
+	})
+
+	t.Run("shutdown", func(t *testing.T) {
+		// The stream opened first has seen every event but the c/ ones,
+		// which it filters out, so the next read waits for the end.
+		ended := make(chan error, 1)
+		go func() {
+			_, err := io.ReadAll(stream)
+			ended <- err
+		}()
+		close(done)
+		select {
+		case err := <-ended:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the stream did not end on shutdown")
+		}
+	})
+}
@@ -0,0 +1,105 @@
+// Command dbtool exports and imports the data of a database directory as JSON
+// Lines, the format of /admin/export and /admin/import of cmd/db. It opens
+// the directory itself, so it must not be used while cmd/db runs on it. The
+// store flags, such as -shards, -compression and -encryption-key-file, are
+// those of cmd/db and must match the ones the directory is served with.
+//
+// Every run covers a single namespace, the default one unless -namespace is
+// given. The other namespaces are the directories under <dir>/namespaces.
+// Importing into a namespace that does not exist creates it, and cmd/db
+// serves it on its next start.
+//
+//	dbtool export -dir <dir> [-namespace <name>] [-file <file>] [store flags]
+//	dbtool import -dir <dir> [-namespace <name>] [-file <file>] [store flags]
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+	"github.com/NikitaSutulov/software-architecture-lab4/dbconfig"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: dbtool export|import -dir <dir> [flags]")
+	os.Exit(2)
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+	}
+	command := os.Args[1]
+	if command != "export" && command != "import" {
+		usage()
+	}
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	dir := flags.String("dir", "", "database directory")
+	namespace := flags.String("namespace", dbconfig.DefaultNamespace, "namespace to "+command)
+	file := flags.String("file", "-", "file to "+command+"; - for the standard stream")
+	var config dbconfig.Config
+	config.RegisterFlags(flags)
+	_ = flags.Parse(os.Args[2:])
+	if *dir == "" {
+		usage()
+	}
+
+	opts, err := config.Options()
+	if err != nil {
+		log.Fatal(err)
+	}
+	nsDir, err := dbconfig.NamespaceDir(*dir, *namespace)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if command == "export" {
+		// Exporting a directory that does not exist would create an empty one.
+		if _, err := os.Stat(nsDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	db, err := config.OpenNamespace(*dir, *namespace, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	var n int
+	if command == "export" {
+		out := io.Writer(os.Stdout)
+		if *file != "-" {
+			f, err := os.Create(*file)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			out = f
+		}
+		n, err = datastore.Export(ctx, out, db)
+	} else {
+		in := io.Reader(os.Stdin)
+		if *file != "-" {
+			f, err := os.Open(*file)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			in = f
+		}
+		n, err = datastore.Import(ctx, in, 2*config.MaxValueSize+config.MaxKeySize+1<<10, db.PutMany)
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatalf("Failed to %s after %d entries: %s", command, n, err)
+	}
+	log.Printf("%sed %d entries", command, n)
+}
@@ -1,16 +1,16 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/NikitaSutulov/software-architecture-lab4/dbclient"
 	"github.com/NikitaSutulov/software-architecture-lab4/httptools"
 	"github.com/NikitaSutulov/software-architecture-lab4/signal"
 )
@@ -21,13 +21,9 @@ var report = make(Report)
 const (
 	confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 	confHealthFailure    = "CONF_HEALTH_FAILURE"
-	dbUrl                = "http://db:8083/db/"
+	dbUrl                = "http://db:8083"
 )
 
-type ReqBody struct {
-	Value string `json:"value"`
-}
-
 type RespBody struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
@@ -36,7 +32,7 @@ type RespBody struct {
 func main() {
 	flag.Parse()
 	h := http.NewServeMux()
-	client := http.DefaultClient
+	client := dbclient.New(dbUrl)
 
 	h.HandleFunc("/health", healthHandler)
 	h.HandleFunc("/api/v1/some-data", someDataHandler(client))
@@ -48,17 +44,10 @@ func main() {
 	server := httptools.CreateServer(*port, h)
 	go server.Start()
 
-	buff := new(bytes.Buffer)
-	body := ReqBody{Value: time.Now().Format(time.RFC3339)}
-	json.NewEncoder(buff).Encode(body)
-
-	res, err := client.Post(fmt.Sprintf("%slospollosbrovaros", dbUrl), "application/json", buff)
-	if err != nil {
-		log.Fatalf("Post request failed: %v", err)
+	if err := client.Put("lospollosbrovaros", time.Now().Format(time.RFC3339)); err != nil {
+		log.Fatalf("Put request failed: %v", err)
 	}
 
-	defer res.Body.Close()
-
 	signal.WaitForTerminationSignal()
 }
 
@@ -73,7 +62,7 @@ func healthHandler(rw http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func someDataHandler(client *http.Client) http.HandlerFunc {
+func someDataHandler(client *dbclient.Client) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		key := r.URL.Query().Get("key")
 		if key == "" {
@@ -81,27 +70,24 @@ func someDataHandler(client *http.Client) http.HandlerFunc {
 			return
 		}
 
-		resp, err := client.Get(fmt.Sprintf("%s/%s", dbUrl, key))
+		value, err := client.GetContext(r.Context(), key)
 		if err != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		statusOk := resp.StatusCode >= 200 && resp.StatusCode < 300
-
-		if !statusOk {
-			rw.WriteHeader(resp.StatusCode)
+			var statusErr *dbclient.StatusError
+			switch {
+			case errors.Is(err, dbclient.ErrNotFound):
+				rw.WriteHeader(http.StatusNotFound)
+			case errors.As(err, &statusErr):
+				rw.WriteHeader(statusErr.StatusCode)
+			default:
+				rw.WriteHeader(http.StatusInternalServerError)
+			}
 			return
 		}
 
 		applyDelay()
 		report.Process(r)
 
-		var body RespBody
-		json.NewDecoder(resp.Body).Decode(&body)
-		resp.Body.Close()
-
-		jsonResponseHandler(rw, body)
+		jsonResponseHandler(rw, RespBody{Key: key, Value: value})
 	}
 }
 
@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"context"
+	"sync"
+)
+
+// batchReaders limits the number of keys GetMany reads at the same time.
+const batchReaders = 16
+
+// GetMany returns the values of the keys that exist. Missing and deleted keys
+// are left out of the result. The keys are read concurrently.
+func (db *Db) GetMany(ctx context.Context, keys []string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	var (
+		mutex    sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	work := make(chan string)
+	for i := 0; i < batchReaders && i < len(keys); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				value, err := db.GetContext(ctx, key)
+				mutex.Lock()
+				switch {
+				case err == nil:
+					values[key] = value
+				case err != ErrNotFound && firstErr == nil:
+					firstErr = err
+					cancel()
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, key := range keys {
+		select {
+		case work <- key:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// PutMany writes the entries in order. Sizes of all entries are checked
+// before anything is written, but the writes are not atomic: after another
+// error the entries before the failed one stay written.
+func (db *Db) PutMany(ctx context.Context, entries []*Entry) error {
+	for _, e := range entries {
+		if len(e.key) > db.maxKeySize {
+			return ErrKeyTooLarge
+		}
+		if len(e.value) > db.maxValueSize {
+			return ErrValueTooLarge
+		}
+	}
+	for _, e := range entries {
+		if err := db.PutContext(ctx, e.key, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
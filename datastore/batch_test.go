@@ -0,0 +1,75 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Batch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1<<10, WithMaxKeySize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var entries []*Entry
+	var keys []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		entries = append(entries, NewEntry(key, fmt.Sprintf("value-%d", i)))
+		keys = append(keys, key)
+	}
+	entries = append(entries, NewEntry("key-0", "overwritten"))
+	if err := db.PutMany(context.Background(), entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("key-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("get many", func(t *testing.T) {
+		values, err := db.GetMany(context.Background(), append(keys, "missing"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(values) != 49 {
+			t.Errorf("Expected 49 values, got %d", len(values))
+		}
+		if values["key-0"] != "overwritten" || values["key-49"] != "value-49" {
+			t.Errorf("Unexpected values: %v", values)
+		}
+		if _, ok := values["key-1"]; ok {
+			t.Error("Deleted key returned")
+		}
+	})
+
+	t.Run("check sizes before writing", func(t *testing.T) {
+		err := db.PutMany(context.Background(), []*Entry{
+			NewEntry("new", "value"),
+			NewEntry("a-key-that-is-too-long", "value"),
+		})
+		if err != ErrKeyTooLarge {
+			t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+		}
+		if _, err := db.Get("new"); err != ErrNotFound {
+			t.Errorf("Expected nothing to be written, got %v", err)
+		}
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := db.GetMany(ctx, keys); err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	})
+}
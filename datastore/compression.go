@@ -0,0 +1,78 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Codec identifies how the value of a record is compressed on disk. It is
+// stored in the header of every record, so records written with different
+// codecs can live in the same segment.
+type Codec byte
+
+const (
+	CodecNone Codec = iota
+	CodecFlate
+	CodecGzip
+)
+
+func compress(codec Codec, value string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch codec {
+	case CodecNone:
+		return []byte(value), nil
+	case CodecFlate:
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		w = fw
+	case CodecGzip:
+		w = gzip.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("unknown codec %d", codec)
+	}
+
+	if _, err := io.WriteString(w, value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress returns the value in data. Values decompressing to more than
+// limit bytes fail with ErrValueTooLarge, so a small record cannot expand
+// into an arbitrarily large one.
+func decompress(codec Codec, data []byte, limit int) (string, error) {
+	var r io.ReadCloser
+	switch codec {
+	case CodecNone:
+		return string(data), nil
+	case CodecFlate:
+		r = flate.NewReader(bytes.NewReader(data))
+	case CodecGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		r = gr
+	default:
+		return "", fmt.Errorf("unknown codec %d", codec)
+	}
+	defer r.Close()
+
+	value, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return "", err
+	}
+	if len(value) > limit {
+		return "", ErrValueTooLarge
+	}
+	return string(value), nil
+}
@@ -3,27 +3,34 @@ package datastore
 import (
 	"bufio"
 	_ "bufio"
+	"context"
 	"encoding/binary"
 	_ "encoding/binary"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 const (
-	outFileName  = "current-data"
-	bufSize      = 8192
-	deleteMarker = "DELETE"
+	outFileName      = "current-data"
+	compactingSuffix = ".compacting"
+	bufSize          = 8192
+	deleteMarker     = "DELETE"
 )
 
 type hashIndex map[string]int64
 
 type IndexOp struct {
-	isWrite bool
-	key     string
-	index   int64
+	key  string
+	resp chan *KeyPosition
 }
 
 type PutOp struct {
@@ -40,45 +47,90 @@ type Db struct {
 	out              *os.File
 	outPath          string
 	outOffset        int64
+	outSegment       *Segment
 	dir              string
 	segmentSize      int64
 	lastSegmentIndex int
 	indexOps         chan IndexOp
-	keyPositions     chan *KeyPosition
 	putOps           chan PutOp
 	putDone          chan error
 	index            hashIndex
 	segments         []*Segment
+	indexMode        IndexMode
+	compression      Codec
+	compressionMin   int
+	keys             *Keyring
+	maxKeySize       int
+	maxValueSize     int
 	fileMutex        sync.Mutex
 	indexMutex       sync.Mutex
+	segmentsMutex    sync.RWMutex
+	compactionMutex  sync.Mutex
+	closeMutex       sync.RWMutex
+	closed           bool
+	writeErr         error
+	routines         sync.WaitGroup
+	compactions      sync.WaitGroup
+	statsMutex       sync.Mutex
+	liveKeys         int64
+	liveBytes        int64
+	compactionRuns   int64
+	putLatency       LatencyStats
+	getLatency       LatencyStats
+	seq              uint64
+	watchMutex       sync.Mutex
+	watchers         map[*watcher]struct{}
+	history          []Event
+	historySize      int
+	historyBytes     int
+	historyMaxBytes  int
 }
 
 type Segment struct {
 	outOffset int64
-	index     hashIndex
+	index     keyIndex
 	filePath  string
+	file      *os.File
+	keys      *Keyring
+	// maxValueSize bounds the decompressed values read from the segment.
+	maxValueSize int
 }
 
 var (
-	ErrNotFound = fmt.Errorf("record does not exist")
+	ErrNotFound      = fmt.Errorf("record does not exist")
+	ErrKeyTooLarge   = fmt.Errorf("key is too large")
+	ErrValueTooLarge = fmt.Errorf("value is too large")
+	ErrCorrupted     = fmt.Errorf("corrupted record")
+	ErrClosed        = fmt.Errorf("database is closed")
+	ErrReadOnly      = fmt.Errorf("database is in read-only mode")
+
+	// errTornRecord is returned when recovery finds a record cut short by
+	// the end of its segment.
+	errTornRecord = fmt.Errorf("torn record")
 )
 
-func NewDb(dir string, segmentSize int64) (*Db, error) {
+func NewDb(dir string, segmentSize int64, opts ...Option) (*Db, error) {
 	db := &Db{
-		segments:     make([]*Segment, 0),
-		dir:          dir,
-		segmentSize:  segmentSize,
-		indexOps:     make(chan IndexOp),
-		keyPositions: make(chan *KeyPosition),
-		putOps:       make(chan PutOp),
-		putDone:      make(chan error),
+		segments:        make([]*Segment, 0),
+		dir:             dir,
+		segmentSize:     segmentSize,
+		indexOps:        make(chan IndexOp),
+		putOps:          make(chan PutOp),
+		putDone:         make(chan error),
+		maxKeySize:      DefaultMaxKeySize,
+		maxValueSize:    DefaultMaxValueSize,
+		watchers:        make(map[*watcher]struct{}),
+		historySize:     DefaultWatchHistory,
+		historyMaxBytes: DefaultWatchHistoryBytes,
 	}
-
-	if err := db.createSegment(); err != nil {
-		return nil, err
+	for _, opt := range opts {
+		opt(db)
+	}
+	if db.maxRecordSize() > math.MaxUint32 {
+		return nil, fmt.Errorf("max key and value sizes do not fit into a record")
 	}
 
-	if err := db.recoverAll(); err != nil && err != io.EOF {
+	if err := db.openSegments(); err != nil {
 		return nil, err
 	}
 
@@ -88,23 +140,45 @@ func NewDb(dir string, segmentSize int64) (*Db, error) {
 	return db, nil
 }
 
+// Close stops accepting new operations, waits for the pending ones and for a
+// running compaction to finish, then syncs and closes all segment files.
+// Operations on a closed database return ErrClosed.
 func (db *Db) Close() error {
-	return db.out.Close()
+	db.closeMutex.Lock()
+	if db.closed {
+		db.closeMutex.Unlock()
+		return ErrClosed
+	}
+	db.closed = true
+	db.closeMutex.Unlock()
+
+	close(db.putOps)
+	close(db.indexOps)
+	db.routines.Wait()
+	db.compactions.Wait()
+	db.stopWatchers()
+
+	err := db.out.Sync()
+	if closeErr := db.out.Close(); err == nil {
+		err = closeErr
+	}
+	for _, s := range db.segments {
+		s.file.Close()
+	}
+	return err
 }
 
 func (db *Db) startIndexRoutine() {
+	db.routines.Add(1)
 	go func() {
+		defer db.routines.Done()
 		for op := range db.indexOps {
 			db.indexMutex.Lock()
-			if op.isWrite {
-				db.setKey(op.key, op.index)
+			s, p, err := db.getSegmentAndPos(op.key)
+			if err != nil {
+				op.resp <- nil
 			} else {
-				s, p, err := db.getSegmentAndPos(op.key)
-				if err != nil {
-					db.keyPositions <- nil
-				} else {
-					db.keyPositions <- &KeyPosition{s, p}
-				}
+				op.resp <- &KeyPosition{s, p}
 			}
 			db.indexMutex.Unlock()
 		}
@@ -112,58 +186,200 @@ func (db *Db) startIndexRoutine() {
 }
 
 func (db *Db) startPutRoutine() {
+	db.routines.Add(1)
 	go func() {
-		for {
-			op := <-db.putOps
+		defer db.routines.Done()
+		for op := range db.putOps {
 			db.fileMutex.Lock()
-			length := op.entry.GetLength()
-			stat, err := db.out.Stat()
+			if db.writeErr != nil {
+				op.resp <- fmt.Errorf("%w: %v", ErrReadOnly, db.writeErr)
+				db.fileMutex.Unlock()
+				continue
+			}
+			seq := db.seq + 1
+			data, err := db.encodeEntry(&op.entry, seq, time.Now().UnixNano())
 			if err != nil {
 				op.resp <- err
 				db.fileMutex.Unlock()
 				continue
 			}
-			if stat.Size()+length > db.segmentSize {
+			length := int64(len(data))
+			db.segmentsMutex.RLock()
+			db.indexMutex.Lock()
+			prevSize := db.liveRecordSize(op.entry.key)
+			db.indexMutex.Unlock()
+			db.segmentsMutex.RUnlock()
+			// A record is never appended to a non-empty segment it does not fit
+			// into. A record larger than a whole segment overflows the fresh
+			// segment it is written to, so the next record rolls over again and
+			// the large one ends up in a segment of its own.
+			rolledOver := false
+			if db.outOffset > 0 && db.outOffset+length > db.segmentSize {
 				err := db.createSegment()
 				if err != nil {
 					op.resp <- err
 					db.fileMutex.Unlock()
 					continue
 				}
+				rolledOver = true
 			}
-			n, err := db.out.Write(op.entry.Encode())
-			if err == nil {
-				db.indexOps <- IndexOp{
-					isWrite: true,
-					key:     op.entry.key,
-					index:   int64(n),
-				}
+			n, err := db.out.Write(data)
+			if err != nil {
+				db.failWrites(err)
+				op.resp <- err
+				db.fileMutex.Unlock()
+				continue
 			}
+			db.indexMutex.Lock()
+			db.setKey(db.outSegment, op.entry.key, int64(n))
+			db.indexMutex.Unlock()
+			db.outOffset += int64(n)
+			db.trackWrite(prevSize, int64(n), op.entry.value == deleteMarker)
+			db.publish(seq, &op.entry)
 			op.resp <- nil
 			db.fileMutex.Unlock()
+			if rolledOver {
+				db.performOldSegmentsCompaction()
+			}
 		}
 	}()
 }
 
+// failWrites switches the database into read-only mode after a failed write.
+// A partially written record is cut off, so the segment can still be
+// recovered, and all further writes are rejected with ErrReadOnly.
+func (db *Db) failWrites(err error) {
+	db.writeErr = err
+	_ = db.out.Truncate(db.outOffset)
+}
+
+// Degraded returns the write error that switched the database into read-only
+// mode, or nil if the database accepts writes.
+func (db *Db) Degraded() error {
+	db.fileMutex.Lock()
+	defer db.fileMutex.Unlock()
+	return db.writeErr
+}
+
+// encodeEntry compresses the value of the entry with the configured codec
+// when it is at least compressionMin bytes long and compression pays off,
+// then seals the record with the current encryption key, if any. modified is
+// the write time in Unix nanoseconds.
+func (db *Db) encodeEntry(e *Entry, seq uint64, modified int64) ([]byte, error) {
+	data := e.Encode()
+	if db.compression != CodecNone && len(e.value) >= db.compressionMin {
+		compressed, err := e.EncodeCompressed(db.compression)
+		if err != nil {
+			return nil, err
+		}
+		if len(compressed) < len(data) {
+			data = compressed
+		}
+	}
+	if e.value == deleteMarker {
+		data[4] |= recordDeleted
+	}
+	binary.LittleEndian.PutUint64(data[6:], seq)
+	binary.LittleEndian.PutUint64(data[14:], uint64(modified))
+	if db.keys != nil {
+		return db.keys.seal(data)
+	}
+	return data, nil
+}
+
+// openSegments recovers the segments left in the directory by a previous
+// run, oldest first, and continues writing into the newest one.
+func (db *Db) openSegments() error {
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+
+	var indexes []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, compactingSuffix) {
+			// Leftover of an interrupted compaction, the original segments are intact.
+			if err := os.Remove(filepath.Join(db.dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasPrefix(name, outFileName) {
+			continue
+		}
+		i, err := strconv.Atoi(strings.TrimPrefix(name, outFileName))
+		if err != nil {
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+	if len(indexes) == 0 {
+		return db.createSegment()
+	}
+	sort.Ints(indexes)
+
+	for n, i := range indexes {
+		segment, err := db.newSegment(filepath.Join(db.dir, fmt.Sprintf("%s%d", outFileName, i)))
+		if err != nil {
+			return err
+		}
+		db.segments = append(db.segments, segment)
+		if err := db.recoverSegment(segment, n == len(indexes)-1); err != nil {
+			return err
+		}
+	}
+	db.lastSegmentIndex = indexes[len(indexes)-1] + 1
+
+	last := db.getLastSegment()
+	f, err := os.OpenFile(last.filePath, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	db.out = f
+	db.outOffset = last.outOffset
+	db.outPath = last.filePath
+	db.outSegment = last
+	return nil
+}
+
+func (db *Db) newSegment(filePath string) (*Segment, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &Segment{
+		filePath:     filePath,
+		file:         f,
+		index:        newIndex(db.indexMode),
+		keys:         db.keys,
+		maxValueSize: db.maxValueSize,
+	}, nil
+}
+
 func (db *Db) createSegment() error {
 	filePath := db.generateNewFileName()
-	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0777)
+	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
 	if err != nil {
 		return err
 	}
-
-	newSegment := &Segment{
-		filePath: filePath,
-		index:    make(hashIndex),
+	newSegment, err := db.newSegment(filePath)
+	if err != nil {
+		f.Close()
+		return err
 	}
 
+	if db.out != nil {
+		db.out.Close()
+	}
 	db.out = f
 	db.outOffset = 0
 	db.outPath = filePath
+	db.outSegment = newSegment
+
+	db.indexMutex.Lock()
 	db.segments = append(db.segments, newSegment)
-	if len(db.segments) >= 3 {
-		db.performOldSegmentsCompaction()
-	}
+	db.indexMutex.Unlock()
 
 	return nil
 }
@@ -174,83 +390,191 @@ func (db *Db) generateNewFileName() string {
 	return result
 }
 
+// performOldSegmentsCompaction merges all segments but the current one into
+// a single segment in the background once there are at least two of them.
+// Only one compaction runs at a time.
 func (db *Db) performOldSegmentsCompaction() {
+	db.indexMutex.Lock()
+	segmentsCount := len(db.segments)
+	db.indexMutex.Unlock()
+	if segmentsCount < 3 || !db.compactionMutex.TryLock() {
+		return
+	}
+	db.compactions.Add(1)
 	go func() {
-		filePath := db.generateNewFileName()
-		newSegment := &Segment{
-			filePath: filePath,
-			index:    make(hashIndex),
-		}
-		var offset int64
-		f, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
-		if err != nil {
-			return
+		defer db.compactions.Done()
+		defer db.compactionMutex.Unlock()
+		_ = db.compactOldSegments()
+	}()
+}
+
+func (db *Db) compactOldSegments() error {
+	// Segments other than the current one are never written again, so their
+	// indexes can be read without holding the lock once copied out.
+	db.indexMutex.Lock()
+	oldSegments := make([]*Segment, len(db.segments)-1)
+	copy(oldSegments, db.segments)
+	db.indexMutex.Unlock()
+	if len(oldSegments) < 2 {
+		return nil
+	}
+
+	// The compacted segment replaces the newest of the old ones, so the
+	// segments keep their order when the database is reopened.
+	last := oldSegments[len(oldSegments)-1]
+	tmpPath := last.filePath + compactingSuffix
+	f, err := os.OpenFile(tmpPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	newSegment, err := db.newSegment(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	sizeDelta, err := db.writeCompactedSegment(f, newSegment, oldSegments)
+	if err != nil {
+		newSegment.file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	db.segmentsMutex.Lock()
+	db.indexMutex.Lock()
+	err = os.Rename(tmpPath, last.filePath)
+	if err == nil {
+		newSegment.filePath = last.filePath
+		db.segments = append([]*Segment{newSegment}, db.segments[len(oldSegments):]...)
+	}
+	db.indexMutex.Unlock()
+	db.segmentsMutex.Unlock()
+	if err != nil {
+		newSegment.file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	for _, s := range oldSegments {
+		s.file.Close()
+		if s != last {
+			os.Remove(s.filePath)
 		}
-		lastSegmentIndex := len(db.segments) - 2
-		for i := 0; i <= lastSegmentIndex; i++ {
-			s := db.segments[i]
-			for key, index := range s.index {
-				if i < lastSegmentIndex {
-					isInNewerSegments := findKeyInSegments(db.segments[i+1:lastSegmentIndex+1], key)
-					if isInNewerSegments {
-						continue
-					}
-				}
-				value, _ := s.getFromSegment(index)
-				if value == deleteMarker {
+	}
+
+	db.statsMutex.Lock()
+	db.liveBytes += sizeDelta
+	db.compactionRuns++
+	db.statsMutex.Unlock()
+	return nil
+}
+
+// writeCompactedSegment copies the newest records of the live keys of the old
+// segments into f. It returns the change of the size of the live records
+// caused by rewriting them with the current compression and encryption.
+func (db *Db) writeCompactedSegment(f *os.File, newSegment *Segment, oldSegments []*Segment) (int64, error) {
+	var sizeDelta int64
+	lastSegmentIndex := len(oldSegments) - 1
+	for i, s := range oldSegments {
+		var positions []int64
+		s.index.forEach(func(position int64) {
+			positions = append(positions, position)
+		})
+		for _, position := range positions {
+			record, err := s.getRecord(position)
+			if err != nil {
+				return 0, err
+			}
+			key, err := recordKey(record, s.keys)
+			if err != nil {
+				return 0, err
+			}
+			if i < lastSegmentIndex {
+				isInNewerSegments := findKeyInSegments(oldSegments[i+1:], key)
+				if isInNewerSegments {
 					continue
 				}
-				e := Entry{
-					key:   key,
-					value: value,
+			}
+			header := parseRecordHeader(record)
+			if header.deleted {
+				continue
+			}
+			// A value over a lowered limit cannot be decompressed, so its
+			// record is copied as it is.
+			data := record
+			e, err := decodeRecord(record, s.keys, s.maxValueSize)
+			switch {
+			case err == nil:
+				if data, err = db.encodeEntry(e, header.seq, header.modified); err != nil {
+					return 0, err
 				}
-				n, err := f.Write(e.Encode())
-				if err == nil {
-					newSegment.index[key] = offset
-					offset += int64(n)
+			case err != ErrValueTooLarge:
+				return 0, err
+			}
+			n, err := f.Write(data)
+			if err != nil {
+				return 0, err
+			}
+			db.setKey(newSegment, key, int64(n))
+
+			if header.size != int64(n) {
+				db.indexMutex.Lock()
+				newest, newestPos, err := db.getSegmentAndPos(key)
+				db.indexMutex.Unlock()
+				if err == nil && newest == s && newestPos == position {
+					sizeDelta += int64(n) - header.size
 				}
 			}
 		}
-		db.segments = []*Segment{newSegment, db.getLastSegment()}
-	}()
+	}
+	return sizeDelta, f.Sync()
 }
 
 func findKeyInSegments(segments []*Segment, key string) bool {
 	for _, s := range segments {
-		if _, ok := s.index[key]; ok {
+		if _, ok := s.index.get(key, s.getKeyFromSegment); ok {
 			return true
 		}
 	}
 	return false
 }
 
-func (db *Db) recoverAll() error {
-	for _, segment := range db.segments {
-		if err := db.recoverSegment(segment); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (db *Db) recoverSegment(segment *Segment) error {
+// recoverSegment indexes the records of a segment. A crash during a write
+// may leave a torn record at the end of the newest segment, which is cut off.
+// A torn record anywhere else means the data is damaged.
+func (db *Db) recoverSegment(segment *Segment, newest bool) error {
 	f, err := os.Open(segment.filePath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	if err := db.recover(f); err != nil && err != io.EOF {
+	err = db.recover(segment, f)
+	if err == errTornRecord && newest {
+		log.Printf("Truncating the torn record at offset %d of %s", segment.outOffset, segment.filePath)
+		return os.Truncate(segment.filePath, segment.outOffset)
+	}
+	if err == errTornRecord {
+		return ErrCorrupted
+	}
+	if err != nil && err != io.EOF {
 		return err
 	}
 
 	return nil
 }
 
-func (db *Db) recover(f *os.File) error {
+func (db *Db) recover(segment *Segment, f *os.File) error {
 	var err error
 	var buf [bufSize]byte
 
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	remaining := stat.Size()
+
 	in := bufio.NewReaderSize(f, bufSize)
 	for err == nil {
 		var (
@@ -265,37 +589,62 @@ func (db *Db) recover(f *os.File) error {
 		} else if err != nil {
 			return err
 		}
+		if len(header) < 4 {
+			return errTornRecord
+		}
+		// The size is not checked against the limits, which may have been
+		// lowered since the record was written.
 		size := binary.LittleEndian.Uint32(header)
+		if size < minRecordSize {
+			return ErrCorrupted
+		}
+		if int64(size) > remaining {
+			return errTornRecord
+		}
+		remaining -= int64(size)
 
 		if size < bufSize {
 			data = buf[:size]
 		} else {
 			data = make([]byte, size)
 		}
-		n, err = in.Read(data)
+		n, err = io.ReadFull(in, data)
 
 		if err == nil {
 			if n != int(size) {
 				return fmt.Errorf("corrupted file")
 			}
 
-			var e Entry
-			e.Decode(data)
-			db.setKey(e.key, int64(n))
+			key, err := recordKey(data, db.keys)
+			if err != nil {
+				return err
+			}
+			header := parseRecordHeader(data)
+			if header.seq > db.seq {
+				db.seq = header.seq
+			}
+			prevSize := db.liveRecordSize(key)
+			db.setKey(segment, key, int64(n))
+			db.trackWrite(prevSize, int64(n), header.deleted)
 		}
 	}
 	return err
 }
 
-func (db *Db) setKey(key string, n int64) {
-	db.getLastSegment().index[key] = db.outOffset
-	db.outOffset += n
+// maxRecordSize is the size of the largest record a write may produce.
+func (db *Db) maxRecordSize() int64 {
+	return int64(db.maxKeySize) + int64(db.maxValueSize) + maxRecordOverhead
+}
+
+func (db *Db) setKey(s *Segment, key string, n int64) {
+	s.index.set(key, s.outOffset, s.getKeyFromSegment)
+	s.outOffset += n
 }
 
 func (db *Db) getSegmentAndPos(key string) (*Segment, int64, error) {
 	for i := range db.segments {
 		s := db.segments[len(db.segments)-i-1]
-		pos, ok := s.index[key]
+		pos, ok := s.index.get(key, s.getKeyFromSegment)
 		if ok {
 			return s, pos, nil
 		}
@@ -304,68 +653,248 @@ func (db *Db) getSegmentAndPos(key string) (*Segment, int64, error) {
 	return nil, 0, ErrNotFound
 }
 
-func (db *Db) getPos(key string) *KeyPosition {
+func (db *Db) getPos(ctx context.Context, key string) (*KeyPosition, error) {
 	op := IndexOp{
-		isWrite: false,
-		key:     key,
+		key:  key,
+		resp: make(chan *KeyPosition, 1),
+	}
+	select {
+	case db.indexOps <- op:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case keyPos := <-op.resp:
+		return keyPos, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	db.indexOps <- op
-	return <-db.keyPositions
 }
 
 func (db *Db) Get(key string) (string, error) {
-	keyPos := db.getPos(key)
+	return db.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get but gives up waiting for the index lookup when ctx
+// is done, returning the context error.
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	r, err := db.GetRecordContext(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return r.Value, nil
+}
+
+// Record is a value together with the write that stored it.
+type Record struct {
+	Value string
+	// Seq is the sequence number of the write. It changes with every write
+	// of the key, so it identifies the version of the value.
+	Seq      uint64
+	Modified time.Time
+}
+
+// GetRecordContext is like GetContext but also returns the sequence number
+// and the time of the write that stored the value.
+func (db *Db) GetRecordContext(ctx context.Context, key string) (*Record, error) {
+	db.closeMutex.RLock()
+	defer db.closeMutex.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer db.observeLatency(&db.getLatency, time.Now())
+	db.segmentsMutex.RLock()
+	defer db.segmentsMutex.RUnlock()
+
+	keyPos, err := db.getPos(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 	if keyPos == nil {
-		return "", ErrNotFound
+		return nil, ErrNotFound
 	}
-	value, err := keyPos.segment.getFromSegment(keyPos.position)
+	header, err := keyPos.segment.getRecordHeader(keyPos.position)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if value == deleteMarker {
-		return "", ErrNotFound
+	if header.deleted {
+		return nil, ErrNotFound
 	}
-	return value, nil
+	value, err := keyPos.segment.getFromSegment(keyPos.position)
+	if err != nil {
+		return nil, err
+	}
+	return &Record{Value: value, Seq: header.seq, Modified: time.Unix(0, header.modified)}, nil
 }
 
 func (db *Db) Put(key, value string) error {
-	resp := make(chan error)
-	db.putOps <- PutOp{
+	return db.PutContext(context.Background(), key, value)
+}
+
+// PutContext is like Put but gives up waiting for the write when ctx is done,
+// returning the context error. A write abandoned after it has been queued may
+// still be applied.
+func (db *Db) PutContext(ctx context.Context, key, value string) error {
+	if len(key) > db.maxKeySize {
+		return ErrKeyTooLarge
+	}
+	if len(value) > db.maxValueSize {
+		return ErrValueTooLarge
+	}
+	db.closeMutex.RLock()
+	defer db.closeMutex.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer db.observeLatency(&db.putLatency, time.Now())
+	op := PutOp{
 		entry: Entry{
 			key:   key,
 			value: value,
 		},
-		resp: resp,
+		resp: make(chan error, 1),
+	}
+	select {
+	case db.putOps <- op:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-op.resp:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	err := <-resp
-	close(resp)
-	return err
 }
 
 func (db *Db) Delete(key string) error {
-	return db.Put(key, deleteMarker)
+	return db.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete but honours the cancellation of ctx the same
+// way PutContext does.
+func (db *Db) DeleteContext(ctx context.Context, key string) error {
+	return db.PutContext(ctx, key, deleteMarker)
+}
+
+// IndexMemoryUsage returns the approximate number of bytes held in memory by
+// the key indexes of all segments.
+func (db *Db) IndexMemoryUsage() int64 {
+	db.indexMutex.Lock()
+	defer db.indexMutex.Unlock()
+
+	var total int64
+	for _, s := range db.segments {
+		total += s.index.memoryUsage()
+	}
+	return total
+}
+
+// Keys returns the keys that are not deleted, in no particular order. Keys
+// written while Keys runs may or may not be included.
+func (db *Db) Keys() ([]string, error) {
+	db.closeMutex.RLock()
+	defer db.closeMutex.RUnlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	// Holding the compaction lock keeps the segments from being merged and
+	// their files closed while they are read. Unlike segmentsMutex, it does
+	// not block writes: a rollover during the scan just skips compaction.
+	db.compactionMutex.Lock()
+	defer db.compactionMutex.Unlock()
+
+	db.indexMutex.Lock()
+	segments := make([]*Segment, len(db.segments))
+	copy(segments, db.segments)
+	positions := make([][]int64, len(segments))
+	for i, s := range segments {
+		s.index.forEach(func(position int64) {
+			positions[i] = append(positions[i], position)
+		})
+	}
+	db.indexMutex.Unlock()
+
+	seen := make(map[string]struct{})
+	var keys []string
+	for i := len(segments) - 1; i >= 0; i-- {
+		s := segments[i]
+		for _, position := range positions[i] {
+			key, err := s.getKeyFromSegment(position)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			header, err := s.getRecordHeader(position)
+			if err != nil {
+				return nil, err
+			}
+			if !header.deleted {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
 }
 
 func (db *Db) getLastSegment() *Segment {
 	return db.segments[len(db.segments)-1]
 }
 
+func (s *Segment) readAt(position int64, read func(in *bufio.Reader) error) error {
+	return read(bufio.NewReader(io.NewSectionReader(s.file, position, math.MaxInt64-position)))
+}
+
+func (s *Segment) getRecordHeader(position int64) (recordHeader, error) {
+	var header [headerSize]byte
+	if _, err := s.file.ReadAt(header[:], position); err != nil {
+		return recordHeader{}, err
+	}
+	return parseRecordHeader(header[:]), nil
+}
+
 func (s *Segment) getFromSegment(position int64) (string, error) {
-	file, err := os.Open(s.filePath)
+	var value string
+	err := s.readAt(position, func(in *bufio.Reader) (err error) {
+		value, err = readValue(in, s.keys, s.maxValueSize)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
-	defer file.Close()
+	return value, nil
+}
 
-	_, err = file.Seek(position, 0)
+func (s *Segment) getKeyFromSegment(position int64) (string, error) {
+	var key string
+	err := s.readAt(position, func(in *bufio.Reader) (err error) {
+		key, err = readKey(in, s.keys)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
+	return key, nil
+}
 
-	reader := bufio.NewReader(file)
-	value, err := readValue(reader)
-	if err != nil {
-		return "", err
+// getRecord returns the record at position as it is stored.
+func (s *Segment) getRecord(position int64) ([]byte, error) {
+	var size [4]byte
+	if _, err := s.file.ReadAt(size[:], position); err != nil {
+		return nil, err
 	}
-	return value, nil
+	data := make([]byte, binary.LittleEndian.Uint32(size[:]))
+	if _, err := s.file.ReadAt(data, position); err != nil {
+		return nil, err
+	}
+	return data, nil
 }
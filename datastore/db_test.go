@@ -1,9 +1,17 @@
 package datastore
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -15,7 +23,7 @@ func TestDb_Put(t *testing.T) {
 	}
 	defer os.RemoveAll(saveDirectory)
 
-	dataBase, err := NewDb(saveDirectory, 45)
+	dataBase, err := NewDb(saveDirectory, 99)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -76,7 +84,7 @@ func TestDb_Put(t *testing.T) {
 		if err := dataBase.Close(); err != nil {
 			t.Fatal(err)
 		}
-		dataBase, err = NewDb(saveDirectory, 45)
+		dataBase, err = NewDb(saveDirectory, 99)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -94,6 +102,31 @@ func TestDb_Put(t *testing.T) {
 	})
 }
 
+// segmentCount counts the segments under the index lock, which compaction
+// holds while it swaps them.
+func segmentCount(db *Db) int {
+	db.indexMutex.Lock()
+	defer db.indexMutex.Unlock()
+	return len(db.segments)
+}
+
+// waitForSegments waits for a background compaction to leave the database
+// with the expected number of segments.
+func waitForSegments(t *testing.T, db *Db, expected int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		actual := segmentCount(db)
+		if actual == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d segments, got %d", expected, actual)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func TestDb_Segmentation(t *testing.T) {
 	saveDirectory, err := ioutil.TempDir("", "testDir")
 	if err != nil {
@@ -101,7 +134,7 @@ func TestDb_Segmentation(t *testing.T) {
 	}
 	defer os.RemoveAll(saveDirectory)
 
-	db, err := NewDb(saveDirectory, 35)
+	db, err := NewDb(saveDirectory, 86)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -112,28 +145,27 @@ func TestDb_Segmentation(t *testing.T) {
 		db.Put("2", "v2")
 		db.Put("3", "v3")
 		db.Put("2", "v5")
-		actualTwoFiles := len(db.segments)
+		actualTwoFiles := segmentCount(db)
 		expected2Files := 2
 		if actualTwoFiles != expected2Files {
-			t.Errorf("An error occurred during segmentation. Expected 2 files, but received %d.", len(db.segments))
+			t.Errorf("An error occurred during segmentation. Expected 2 files, but received %d.", actualTwoFiles)
 		}
 	})
 
 	t.Run("check starting segmentation", func(t *testing.T) {
+		// Holding the compaction lock keeps the rollover from starting a
+		// compaction before the segments are counted.
+		db.compactionMutex.Lock()
 		db.Put("4", "v4")
-		actualTreeFiles := len(db.segments)
+		actualTreeFiles := segmentCount(db)
+		db.compactionMutex.Unlock()
 		expected3Files := 3
 		if actualTreeFiles != expected3Files {
-			t.Errorf("An error occurred during segmentation. Expected 3 files, but received %d.", len(db.segments))
+			t.Errorf("An error occurred during segmentation. Expected 3 files, but received %d.", actualTreeFiles)
 		}
 
-		time.Sleep(2 * time.Second)
-
-		actualTwoFiles := len(db.segments)
-		expected2Files := 2
-		if actualTwoFiles != expected2Files {
-			t.Errorf("An error occurred during segmentation. Expected 2 files, but received %d.", len(db.segments))
-		}
+		db.performOldSegmentsCompaction()
+		waitForSegments(t, db, 2)
 	})
 
 	t.Run("check not storing new values of duplicate keys", func(t *testing.T) {
@@ -153,7 +185,7 @@ func TestDb_Segmentation(t *testing.T) {
 		}
 		inf, _ := file.Stat()
 		actual := inf.Size()
-		expected := int64(45)
+		expected := int64(99)
 		if actual != expected {
 			t.Errorf("An error occurred during segmentation. Expected size %d, Actual one: %d", expected, actual)
 		}
@@ -217,4 +249,784 @@ func TestDb_Delete(t *testing.T) {
 			t.Errorf("Expected ErrNotFound for non-existing key, got: %v", err)
 		}
 	})
+
+	t.Run("list live keys", func(t *testing.T) {
+		keys, err := db.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		if strings.Join(keys, ",") != "key1,key3" {
+			t.Errorf("Expected live keys key1,key3, got %v", keys)
+		}
+	})
+}
+
+func TestDb_KeysDuringWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Writes rolling over segments keep going while the keys are listed.
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 200; i++ {
+			if err := db.Put(fmt.Sprintf("key%d", i%20), fmt.Sprintf("value%d", i)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 20; i++ {
+		keys, err := db.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 20 {
+			t.Fatalf("Expected 20 keys, got %d", len(keys))
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDb_CompactIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 150, WithIndexMode(IndexModeCompact))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	pairs := [][]string{
+		{"key1", "value1"},
+		{"key2", "value2"},
+		{"key1", "value3"},
+	}
+	for _, pair := range pairs {
+		if err := db.Put(pair[0], pair[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("get latest values", func(t *testing.T) {
+		expected := map[string]string{"key1": "value3", "key2": "value2"}
+		for key, value := range expected {
+			actual, err := db.Get(key)
+			if err != nil {
+				t.Errorf("Unable to retrieve %s: %s", key, err)
+			}
+			if actual != value {
+				t.Errorf("Invalid value returned. Expected: %s, Actual: %s.", value, actual)
+			}
+		}
+		if _, err := db.Get("key3"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for missing key, got: %v", err)
+		}
+	})
+
+	t.Run("report memory usage", func(t *testing.T) {
+		if usage := db.IndexMemoryUsage(); usage != 2*(hashSize+positionSize) {
+			t.Errorf("Unexpected index memory usage: %d", usage)
+		}
+	})
+}
+
+func TestDb_Compression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1<<20, WithCompression(CodecGzip, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	large := strings.Repeat(`{"name":"value"}`, 64)
+	if err := db.Put("small", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("large", large); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]string{"small": "v", "large": large} {
+		actual, err := db.Get(key)
+		if err != nil {
+			t.Errorf("Unable to retrieve %s: %s", key, err)
+		}
+		if actual != expected {
+			t.Errorf("Invalid value returned for %s", key)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dir, outFileName+"0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed := NewEntry("small", "v").GetLength() + NewEntry("large", large).GetLength()
+	if info.Size() >= uncompressed {
+		t.Errorf("Expected compressed segment, got %d bytes (uncompressed %d)", info.Size(), uncompressed)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, err := db.Get("large"); err != nil || actual != large {
+		t.Errorf("Unable to retrieve compressed value after reopening: %v", err)
+	}
+}
+
+func TestDb_Encryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKeys, err := ReadKeyring(strings.NewReader("1:000102030405060708090a0b0c0d0e0f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedKeys, err := ReadKeyring(strings.NewReader(testKeyring))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDb(dir, 1<<20, WithEncryption(oldKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("secret-key", "secret-value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("no plaintext on disk", func(t *testing.T) {
+		data, err := os.ReadFile(filepath.Join(dir, outFileName+"0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "secret") {
+			t.Error("Segment file contains plaintext data")
+		}
+	})
+
+	t.Run("read after key rotation", func(t *testing.T) {
+		db, err := NewDb(dir, 1<<20, WithEncryption(rotatedKeys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		if err := db.Put("new-key", "new-value"); err != nil {
+			t.Fatal(err)
+		}
+		for key, expected := range map[string]string{"secret-key": "secret-value", "new-key": "new-value"} {
+			actual, err := db.Get(key)
+			if err != nil {
+				t.Errorf("Unable to retrieve %s: %s", key, err)
+			}
+			if actual != expected {
+				t.Errorf("Invalid value returned. Expected: %s, Actual: %s.", expected, actual)
+			}
+		}
+	})
+
+	t.Run("missing key", func(t *testing.T) {
+		if _, err := NewDb(dir, 1<<20); err != ErrUnknownKey {
+			t.Errorf("Expected ErrUnknownKey, got %v", err)
+		}
+	})
+}
+
+func TestDb_EncryptionCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKeys, err := ReadKeyring(strings.NewReader("1:000102030405060708090a0b0c0d0e0f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedKeys, err := ReadKeyring(strings.NewReader(testKeyring))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDb(dir, 136, WithEncryption(rotatedKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Write a record sealed with the old key directly, as if it was left over from before the rotation.
+	data, err := oldKeys.seal(NewEntry("old", "value").Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := db.out.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.setKey(db.outSegment, "old", int64(n))
+	db.outOffset += int64(n)
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		if err := db.Put(key, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForSegments(t, db, 2)
+
+	db.indexMutex.Lock()
+	compacted := db.segments[0]
+	db.indexMutex.Unlock()
+	compacted.index.forEach(func(position int64) {
+		raw, err := os.ReadFile(compacted.filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw[position+5] != 2 {
+			t.Errorf("Expected record at %d to be sealed with key 2, got key %d", position, raw[position+5])
+		}
+	})
+	if actual, err := db.Get("old"); err != nil || actual != "value" {
+		t.Errorf("Unable to retrieve re-encrypted value: %v", err)
+	}
+}
+
+func TestDb_SizeLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 45, WithMaxKeySize(8), WithMaxValueSize(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("reject large keys and values", func(t *testing.T) {
+		if err := db.Put("too-long-key", "v"); err != ErrKeyTooLarge {
+			t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+		}
+		if err := db.Put("key", strings.Repeat("v", 101)); err != ErrValueTooLarge {
+			t.Errorf("Expected ErrValueTooLarge, got %v", err)
+		}
+		if _, err := db.Get("key"); err != ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a rejected record, got %v", err)
+		}
+	})
+
+	t.Run("record larger than a segment", func(t *testing.T) {
+		large := strings.Repeat("v", 100)
+		if err := db.Put("key", large); err != nil {
+			t.Fatal(err)
+		}
+		if len(db.segments) != 1 {
+			t.Errorf("Expected the record to be written into the empty segment, got %d segments", len(db.segments))
+		}
+		if actual, err := db.Get("key"); err != nil || actual != large {
+			t.Errorf("Unable to retrieve large value: %v", err)
+		}
+	})
+
+	t.Run("invalid limits", func(t *testing.T) {
+		if _, err := NewDb(dir, 45, WithMaxKeySize(math.MaxUint32)); err == nil {
+			t.Error("Expected an error for limits that do not fit into a record")
+		}
+	})
+}
+
+func TestDb_RecoverLargeRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := strings.Repeat("v", 3*bufSize)
+	if err := db.Put("large", large); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("small", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual, err := db.Get("large"); err != nil || actual != large {
+		t.Errorf("Unable to retrieve large value after reopening: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("truncated record", func(t *testing.T) {
+		path := filepath.Join(dir, outFileName+"0")
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(path, info.Size()-1); err != nil {
+			t.Fatal(err)
+		}
+		db, err := NewDb(dir, 1<<20)
+		if err != nil {
+			t.Fatalf("Expected the torn record to be cut off, got %v", err)
+		}
+		if actual, err := db.Get("large"); err != nil || actual != large {
+			t.Errorf("Unable to retrieve the record before the torn one: %v", err)
+		}
+		if _, err := db.Get("small"); err != ErrNotFound {
+			t.Errorf("Expected the torn record to be lost, got %v", err)
+		}
+		if err := db.Put("small", "again"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = NewDb(dir, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual, err := db.Get("small"); err != nil || actual != "again" {
+			t.Errorf("Unable to retrieve the record written after the truncation: %v", err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("truncated record in older segment", func(t *testing.T) {
+		path := filepath.Join(dir, outFileName+"0")
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(path, info.Size()-1); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, outFileName+"1"), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewDb(dir, 1<<20); err != ErrCorrupted {
+			t.Errorf("Expected ErrCorrupted, got %v", err)
+		}
+	})
+
+	t.Run("invalid record size", func(t *testing.T) {
+		path := filepath.Join(dir, outFileName+"0")
+		f, err := os.OpenFile(path, os.O_WRONLY, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt([]byte{1, 0, 0, 0}, 0); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		os.Remove(filepath.Join(dir, outFileName+"1"))
+		if _, err := NewDb(dir, 1<<20); err != ErrCorrupted {
+			t.Errorf("Expected ErrCorrupted, got %v", err)
+		}
+	})
+}
+
+func TestDb_LoweredLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1<<20, WithCompression(CodecGzip, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := strings.Repeat("v", 1000)
+	for _, key := range []string{"large", strings.Repeat("k", 200)} {
+		if err := db.Put(key, large); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("small", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records larger than the new limits are recovered, only values that
+	// decompress beyond the limit cannot be read.
+	db, err = NewDb(dir, 1<<20, WithMaxKeySize(100), WithMaxValueSize(100))
+	if err != nil {
+		t.Fatalf("Failed to reopen with lowered limits: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Get("large"); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+	if actual, err := db.Get("small"); err != nil || actual != "v" {
+		t.Errorf("Unable to retrieve small value: %q, %v", actual, err)
+	}
+	if err := db.Put("large", large); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge on put, got %v", err)
+	}
+
+	// Compaction copies the records it cannot decompress as they are.
+	if err := db.createSegment(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.createSegment(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.compactOldSegments(); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+	if _, err := db.Get("large"); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge after compaction, got %v", err)
+	}
+	if actual, err := db.Get("small"); err != nil || actual != "v" {
+		t.Errorf("Unable to retrieve small value after compaction: %q, %v", actual, err)
+	}
+}
+
+func TestDb_Rollover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	length := NewEntry("k1", "vv").GetLength()
+	db, err := NewDb(dir, 2*length)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := strings.Repeat("v", int(3*length))
+	steps := []struct {
+		name, key, value string
+		segment          string
+		offset           int64
+	}{
+		{"below the limit", "k1", "vv", outFileName + "0", length},
+		{"at the limit", "k2", "vv", outFileName + "0", 2 * length},
+		{"over the limit", "k3", "vv", outFileName + "1", length},
+		{"larger than a segment", "k4", large, outFileName + "2", NewEntry("k4", large).GetLength()},
+		{"after a large record", "k5", "vv", outFileName + "3", length},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			if err := db.Put(step.key, step.value); err != nil {
+				t.Fatal(err)
+			}
+			if actual := filepath.Base(db.outPath); actual != step.segment {
+				t.Errorf("Expected the record in %s, got %s", step.segment, actual)
+			}
+			if db.outOffset != step.offset {
+				t.Errorf("Expected offset %d, got %d", step.offset, db.outOffset)
+			}
+		})
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		db, err := NewDb(dir, 2*length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for _, step := range steps {
+			actual, err := db.Get(step.key)
+			if err != nil {
+				t.Errorf("Unable to retrieve %s: %s", step.key, err)
+			}
+			if actual != step.value {
+				t.Errorf("Invalid value returned for %s", step.key)
+			}
+		}
+		if actual := filepath.Base(db.outPath); actual != outFileName+"3" {
+			t.Errorf("Expected to continue writing into %s3, got %s", outFileName, actual)
+		}
+		if db.outOffset != length {
+			t.Errorf("Expected offset %d, got %d", length, db.outOffset)
+		}
+
+		if err := db.Put("k6", large); err != nil {
+			t.Fatal(err)
+		}
+		if actual := filepath.Base(db.outPath); actual != outFileName+"4" {
+			t.Errorf("Expected a new segment %s4, got %s", outFileName, actual)
+		}
+	})
+}
+
+func TestDb_Close(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	results := make([]error, 50)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = db.Put(fmt.Sprintf("key%d", i), "value")
+		}(i)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	t.Run("reject operations after close", func(t *testing.T) {
+		if err := db.Put("key", "value"); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Put, got %v", err)
+		}
+		if _, err := db.Get("key0"); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Get, got %v", err)
+		}
+		if err := db.Close(); err != ErrClosed {
+			t.Errorf("Expected ErrClosed from Close, got %v", err)
+		}
+	})
+
+	t.Run("keep accepted writes", func(t *testing.T) {
+		db, err := NewDb(dir, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		for i, result := range results {
+			key := fmt.Sprintf("key%d", i)
+			_, err := db.Get(key)
+			if result == nil && err != nil {
+				t.Errorf("Accepted write of %s is lost: %v", key, err)
+			}
+			if result == ErrClosed && err != ErrNotFound {
+				t.Errorf("Rejected write of %s is stored", key)
+			}
+		}
+	})
+}
+
+func TestDb_Context(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	t.Run("put with stuck writer", func(t *testing.T) {
+		db.fileMutex.Lock()
+		for i := 0; i < 2; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			err := db.PutContext(ctx, "key", "value")
+			cancel()
+			if err != context.DeadlineExceeded {
+				t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+			}
+		}
+		db.fileMutex.Unlock()
+
+		if err := db.Put("key", "value2"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("get with stuck index", func(t *testing.T) {
+		db.indexMutex.Lock()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err := db.GetContext(ctx, "key")
+		cancel()
+		db.indexMutex.Unlock()
+		if err != context.DeadlineExceeded {
+			t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+		}
+
+		value, err := db.Get("key")
+		if err != nil || value != "value2" {
+			t.Errorf("Unexpected value %s: %v", value, err)
+		}
+	})
+
+	t.Run("cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := db.DeleteContext(ctx, "key"); err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	})
+}
+
+func TestDb_GetRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+	if err := db.Put("key", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	first, err := db.GetRecordContext(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Value != "v1" || first.Seq != 1 {
+		t.Errorf("Unexpected record %+v", first)
+	}
+	if first.Modified.Before(before) || first.Modified.After(time.Now()) {
+		t.Errorf("Unexpected modification time %s", first.Modified)
+	}
+
+	// Enough writes of other keys for the record to be compacted.
+	for i := 0; i < 6; i++ {
+		if err := db.Put(fmt.Sprintf("other-%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	db, err = NewDb(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	reopened, err := db.GetRecordContext(context.Background(), "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Seq != first.Seq || !reopened.Modified.Equal(first.Modified) {
+		t.Errorf("Record changed after compaction and reopening: %+v, was %+v", reopened, first)
+	}
+
+	if err := db.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetRecordContext(context.Background(), "key"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+	}
+}
+
+func TestDb_WriteFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes to /dev/full fail with ENOSPC, just like on a full disk.
+	full, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("/dev/full is not available")
+	}
+	db.fileMutex.Lock()
+	db.out.Close()
+	db.out = full
+	db.fileMutex.Unlock()
+
+	t.Run("report the failed write", func(t *testing.T) {
+		if err := db.Put("key2", "value2"); !errors.Is(err, syscall.ENOSPC) {
+			t.Errorf("Expected ENOSPC, got %v", err)
+		}
+		if _, err := db.Get("key2"); err != ErrNotFound {
+			t.Errorf("Expected the failed write not to be indexed, got %v", err)
+		}
+	})
+
+	t.Run("read-only mode", func(t *testing.T) {
+		if err := db.Degraded(); !errors.Is(err, syscall.ENOSPC) {
+			t.Errorf("Expected the database to be degraded, got %v", err)
+		}
+		if err := db.Put("key3", "value3"); !errors.Is(err, ErrReadOnly) {
+			t.Errorf("Expected ErrReadOnly, got %v", err)
+		}
+		if value, err := db.Get("key1"); err != nil || value != "value1" {
+			t.Errorf("Unable to read in read-only mode: %v", err)
+		}
+	})
 }
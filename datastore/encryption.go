@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// sealOverhead is the size of the AES-GCM nonce and authentication tag
+// added to every sealed record.
+const sealOverhead = 12 + 16
+
+var (
+	ErrUnknownKey = fmt.Errorf("record is encrypted with an unknown key")
+)
+
+// Keyring holds the AES-GCM keys records can be encrypted with, indexed by
+// the key id stored in the record header. New records are always sealed with
+// the current key, older keys are only used to read existing records.
+// Key id 0 is reserved for plaintext records.
+type Keyring struct {
+	current byte
+	ciphers map[byte]cipher.AEAD
+}
+
+// NewKeyring creates a keyring from AES keys of 16, 24 or 32 bytes.
+func NewKeyring(keys map[byte][]byte, current byte) (*Keyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current key %d is not in the keyring", current)
+	}
+	k := &Keyring{
+		current: current,
+		ciphers: make(map[byte]cipher.AEAD),
+	}
+	for id, key := range keys {
+		if id == 0 {
+			return nil, fmt.Errorf("key id 0 is reserved for plaintext records")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", id, err)
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", id, err)
+		}
+		k.ciphers[id] = gcm
+	}
+	return k, nil
+}
+
+// ReadKeyring parses a keyring from lines of the form "<id>:<hex key>".
+// Empty lines and lines starting with # are ignored. The key on the last
+// line becomes the current one, so keys are rotated by appending a line.
+func ReadKeyring(r io.Reader) (*Keyring, error) {
+	keys := make(map[byte][]byte)
+	var current byte
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		idStr, keyStr, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed keyring line %q", line)
+		}
+		id, err := strconv.ParseUint(strings.TrimSpace(idStr), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("bad key id %q: %w", idStr, err)
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(keyStr))
+		if err != nil {
+			return nil, fmt.Errorf("bad key %d: %w", id, err)
+		}
+		keys[byte(id)] = key
+		current = byte(id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("keyring is empty")
+	}
+	return NewKeyring(keys, current)
+}
+
+// seal encrypts the payload of a plaintext record with the current key.
+// The record header is authenticated as additional data.
+func (k *Keyring) seal(record []byte) ([]byte, error) {
+	gcm := k.ciphers[k.current]
+	payload := record[headerSize:]
+	size := headerSize + gcm.NonceSize() + len(payload) + gcm.Overhead()
+
+	res := make([]byte, headerSize+gcm.NonceSize(), size)
+	binary.LittleEndian.PutUint32(res, uint32(size))
+	copy(res[4:headerSize], record[4:headerSize])
+	res[5] = k.current
+
+	nonce := res[headerSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(res, nonce, payload, res[:headerSize]), nil
+}
+
+// open decrypts a sealed record back into its plaintext form.
+func (k *Keyring) open(record []byte) ([]byte, error) {
+	if k == nil {
+		return nil, ErrUnknownKey
+	}
+	gcm, ok := k.ciphers[record[5]]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	nonceEnd := headerSize + gcm.NonceSize()
+	if len(record) < nonceEnd+gcm.Overhead() {
+		return nil, ErrCorrupted
+	}
+
+	res := make([]byte, headerSize, len(record)-gcm.NonceSize()-gcm.Overhead())
+	res, err := gcm.Open(res, record[headerSize:nonceEnd], record[nonceEnd:], record[:headerSize])
+	if err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(res, uint32(len(res)))
+	copy(res[4:headerSize], record[4:headerSize])
+	res[5] = 0
+	return res, nil
+}
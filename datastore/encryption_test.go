@@ -0,0 +1,67 @@
+package datastore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const testKeyring = `
+# rotated keys, the last one is current
+1:000102030405060708090a0b0c0d0e0f
+2:101112131415161718191a1b1c1d1e1f101112131415161718191a1b1c1d1e1f
+`
+
+func TestReadKeyring(t *testing.T) {
+	keys, err := ReadKeyring(strings.NewReader(testKeyring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.current != 2 {
+		t.Errorf("Expected current key 2, got %d", keys.current)
+	}
+	if len(keys.ciphers) != 2 {
+		t.Errorf("Expected 2 keys, got %d", len(keys.ciphers))
+	}
+
+	for _, text := range []string{"", "1:zz", "0:000102030405060708090a0b0c0d0e0f", "1:0001"} {
+		if _, err := ReadKeyring(strings.NewReader(text)); err == nil {
+			t.Errorf("Expected an error for keyring %q", text)
+		}
+	}
+}
+
+func TestKeyring_SealOpen(t *testing.T) {
+	keys, err := ReadKeyring(strings.NewReader(testKeyring))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plain := NewEntry("tK", "tV").Encode()
+	sealed, err := keys.seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed[5] != 2 {
+		t.Errorf("Expected key id 2 in the header, got %d", sealed[5])
+	}
+	if bytes.Contains(sealed, []byte("tV")) {
+		t.Error("Sealed record contains the plaintext value")
+	}
+
+	opened, err := keys.open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(opened, plain) {
+		t.Error("Opened record differs from the original one")
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err := keys.open(sealed); err == nil {
+		t.Error("Expected an error for a tampered record")
+	}
+	if _, err := (*Keyring)(nil).open(sealed); err != ErrUnknownKey {
+		t.Errorf("Expected ErrUnknownKey without a keyring, got %v", err)
+	}
+}
@@ -4,6 +4,29 @@ import (
 	"bufio"
 	"encoding/binary"
 	"fmt"
+	"io"
+)
+
+// Records are laid out as:
+//
+//	size (4) | flags (1) | key id (1) | sequence (8) | time (8) | key length (4) | key | value length (4) | value
+//
+// The low bits of the flags byte hold the codec of the value, the high bit
+// marks records of deleted keys. The sequence number orders all writes to the
+// database and the time is when the record was written, in Unix nanoseconds.
+// Everything after the header is encrypted when the key id is not zero.
+const headerSize = 22
+
+const (
+	codecMask     = 0x7f
+	recordDeleted = 0x80
+)
+
+const (
+	minRecordSize = headerSize + 8
+	// maxRecordOverhead is the largest number of bytes a record adds on top of
+	// its key and value: the header, both lengths and the encryption envelope.
+	maxRecordOverhead = minRecordSize + sealOverhead
 )
 
 type Entry struct {
@@ -14,20 +37,42 @@ func NewEntry(key string, value string) *Entry {
 	return &Entry{key: key, value: value}
 }
 
+func (e *Entry) Key() string {
+	return e.key
+}
+
+func (e *Entry) Value() string {
+	return e.value
+}
+
 func getLength(key string, value string) int64 {
-	return int64(len(key) + len(value) + 12)
+	return int64(len(key) + len(value) + headerSize + 8)
 }
 
 func (e *Entry) Encode() []byte {
-	kl := len(e.key)
-	vl := len(e.value)
-	size := kl + vl + 12
+	return encodeRecord(e.key, []byte(e.value), CodecNone)
+}
+
+// EncodeCompressed encodes the entry with its value compressed by codec.
+func (e *Entry) EncodeCompressed(codec Codec) ([]byte, error) {
+	value, err := compress(codec, e.value)
+	if err != nil {
+		return nil, err
+	}
+	return encodeRecord(e.key, value, codec), nil
+}
+
+func encodeRecord(key string, value []byte, codec Codec) []byte {
+	kl := len(key)
+	vl := len(value)
+	size := kl + vl + headerSize + 8
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
-	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
-	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-	copy(res[kl+12:], e.value)
+	res[4] = byte(codec)
+	binary.LittleEndian.PutUint32(res[headerSize:], uint32(kl))
+	copy(res[headerSize+4:], key)
+	binary.LittleEndian.PutUint32(res[kl+headerSize+4:], uint32(vl))
+	copy(res[kl+headerSize+8:], value)
 	return res
 }
 
@@ -35,25 +80,112 @@ func (e *Entry) GetLength() int64 {
 	return getLength(e.key, e.value)
 }
 
-func (e *Entry) Decode(input []byte) {
-	kl := binary.LittleEndian.Uint32(input[4:])
+// Decode decodes a record encoded by Encode or EncodeCompressed. Compressed
+// values may decompress to at most DefaultMaxValueSize bytes.
+func (e *Entry) Decode(input []byte) error {
+	return e.decode(input, DefaultMaxValueSize)
+}
+
+func (e *Entry) decode(input []byte, maxValueSize int) error {
+	if len(input) < minRecordSize {
+		return ErrCorrupted
+	}
+	codec := Codec(input[4] & codecMask)
+	kl := binary.LittleEndian.Uint32(input[headerSize:])
+	if uint64(kl)+minRecordSize > uint64(len(input)) {
+		return ErrCorrupted
+	}
 	keyBuf := make([]byte, kl)
-	copy(keyBuf, input[8:kl+8])
+	copy(keyBuf, input[headerSize+4:kl+headerSize+4])
 	e.key = string(keyBuf)
 
-	vl := binary.LittleEndian.Uint32(input[kl+8:])
-	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+12:kl+12+vl])
-	e.value = string(valBuf)
+	vl := binary.LittleEndian.Uint32(input[kl+headerSize+4:])
+	if uint64(kl)+uint64(vl)+minRecordSize > uint64(len(input)) {
+		return ErrCorrupted
+	}
+	value, err := decompress(codec, input[kl+headerSize+8:kl+headerSize+8+vl], maxValueSize)
+	if err != nil {
+		return err
+	}
+	e.value = value
+	return nil
+}
+
+// decodeRecord decodes a record read from a segment, decrypting it with keys
+// when it is sealed. Compressed values may decompress to at most
+// maxValueSize bytes.
+func decodeRecord(data []byte, keys *Keyring, maxValueSize int) (*Entry, error) {
+	if len(data) < headerSize {
+		return nil, ErrCorrupted
+	}
+	if data[5] != 0 {
+		var err error
+		if data, err = keys.open(data); err != nil {
+			return nil, err
+		}
+	}
+	var e Entry
+	if err := e.decode(data, maxValueSize); err != nil {
+		return nil, err
+	}
+	return &e, nil
 }
 
-func readValue(in *bufio.Reader) (string, error) {
-	header, err := in.Peek(8)
+// recordKey returns the key of a record read from a segment, decrypting it
+// with keys when it is sealed. Unlike decodeRecord, it leaves the value
+// compressed, so it works whatever the size of the value.
+func recordKey(data []byte, keys *Keyring) (string, error) {
+	if len(data) < headerSize {
+		return "", ErrCorrupted
+	}
+	if data[5] != 0 {
+		var err error
+		if data, err = keys.open(data); err != nil {
+			return "", err
+		}
+	}
+	if len(data) < minRecordSize {
+		return "", ErrCorrupted
+	}
+	kl := binary.LittleEndian.Uint32(data[headerSize:])
+	if uint64(kl)+minRecordSize > uint64(len(data)) {
+		return "", ErrCorrupted
+	}
+	return string(data[headerSize+4 : headerSize+4+kl]), nil
+}
+
+// recordHeader is the part of a record that is never encrypted.
+type recordHeader struct {
+	size     int64
+	deleted  bool
+	seq      uint64
+	modified int64
+}
+
+func parseRecordHeader(data []byte) recordHeader {
+	return recordHeader{
+		size:     int64(binary.LittleEndian.Uint32(data)),
+		deleted:  data[4]&recordDeleted != 0,
+		seq:      binary.LittleEndian.Uint64(data[6:]),
+		modified: int64(binary.LittleEndian.Uint64(data[14:])),
+	}
+}
+
+func readValue(in *bufio.Reader, keys *Keyring, maxValueSize int) (string, error) {
+	header, err := in.Peek(headerSize + 4)
 	if err != nil {
 		return "", err
 	}
-	keySize := int(binary.LittleEndian.Uint32(header[4:]))
-	_, err = in.Discard(keySize + 8)
+	if header[5] != 0 {
+		e, err := readEntry(in, keys, maxValueSize)
+		if err != nil {
+			return "", err
+		}
+		return e.value, nil
+	}
+	codec := Codec(header[4] & codecMask)
+	keySize := int(binary.LittleEndian.Uint32(header[headerSize:]))
+	_, err = in.Discard(keySize + headerSize + 4)
 	if err != nil {
 		return "", err
 	}
@@ -69,13 +201,49 @@ func readValue(in *bufio.Reader) (string, error) {
 	}
 
 	data := make([]byte, valSize)
-	n, err := in.Read(data)
+	n, err := io.ReadFull(in, data)
+	if err != nil {
+		return "", fmt.Errorf("can't read value bytes (read %d, expected %d): %w", n, valSize, err)
+	}
+
+	return decompress(codec, data, maxValueSize)
+}
+
+func readKey(in *bufio.Reader, keys *Keyring) (string, error) {
+	header, err := in.Peek(headerSize + 4)
 	if err != nil {
 		return "", err
 	}
-	if n != valSize {
-		return "", fmt.Errorf("can't read value bytes (read %d, expected %d)", n, valSize)
+	if header[5] != 0 {
+		data := make([]byte, binary.LittleEndian.Uint32(header))
+		if _, err := io.ReadFull(in, data); err != nil {
+			return "", err
+		}
+		return recordKey(data, keys)
+	}
+	keySize := int(binary.LittleEndian.Uint32(header[headerSize:]))
+	_, err = in.Discard(headerSize + 4)
+	if err != nil {
+		return "", err
 	}
 
+	data := make([]byte, keySize)
+	if _, err := io.ReadFull(in, data); err != nil {
+		return "", err
+	}
 	return string(data), nil
 }
+
+func readEntry(in *bufio.Reader, keys *Keyring, maxValueSize int) (*Entry, error) {
+	header, err := in.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header)
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(in, data); err != nil {
+		return nil, err
+	}
+	return decodeRecord(data, keys, maxValueSize)
+}
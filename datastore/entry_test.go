@@ -3,6 +3,8 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"encoding/binary"
+	"strings"
 	"testing"
 )
 
@@ -10,7 +12,7 @@ func TestEntry_Encode(t *testing.T) {
 	encoder := Entry{"tK", "tV"}
 	data := encoder.Encode()
 	encoder.Decode(data)
-	if encoder.GetLength() != 16 {
+	if encoder.GetLength() != 34 {
 		t.Error("Incorrect length")
 	}
 	if encoder.key != "tK" {
@@ -26,7 +28,7 @@ func TestReadValue(t *testing.T) {
 	data := encoder.Encode()
 	readData := bytes.NewReader(data)
 	bReadData := bufio.NewReader(readData)
-	value, err := readValue(bReadData)
+	value, err := readValue(bReadData, nil, DefaultMaxValueSize)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -34,3 +36,66 @@ func TestReadValue(t *testing.T) {
 		t.Errorf("Wrong value: [%s]", value)
 	}
 }
+
+func TestEntry_EncodeCompressed(t *testing.T) {
+	value := strings.Repeat(`{"field":"value"}`, 100)
+	for _, codec := range []Codec{CodecNone, CodecFlate, CodecGzip} {
+		e := Entry{"tK", value}
+		data, err := e.EncodeCompressed(codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if codec != CodecNone && len(data) >= int(e.GetLength()) {
+			t.Errorf("Codec %d did not compress the value: %d bytes", codec, len(data))
+		}
+
+		var decoded Entry
+		if err := decoded.Decode(data); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.key != "tK" || decoded.value != value {
+			t.Errorf("Codec %d: wrong entry decoded", codec)
+		}
+
+		actual, err := readValue(bufio.NewReader(bytes.NewReader(data)), nil, DefaultMaxValueSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual != value {
+			t.Errorf("Codec %d: wrong value read", codec)
+		}
+	}
+}
+
+func TestEntry_DecodeCorrupted(t *testing.T) {
+	data := NewEntry("tK", "tV").Encode()
+	binary.LittleEndian.PutUint32(data[headerSize:], 1000)
+
+	var e Entry
+	if err := e.Decode(data); err != ErrCorrupted {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+	if err := e.Decode(data[:5]); err != ErrCorrupted {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+}
+
+func TestEntry_DecodeLimit(t *testing.T) {
+	value := strings.Repeat("0", 1000)
+	for _, codec := range []Codec{CodecFlate, CodecGzip} {
+		data, err := NewEntry("tK", value).EncodeCompressed(codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e Entry
+		if err := e.decode(data, len(value)-1); err != ErrValueTooLarge {
+			t.Errorf("Codec %d: expected ErrValueTooLarge, got %v", codec, err)
+		}
+		if err := e.decode(data, len(value)); err != nil || e.value != value {
+			t.Errorf("Codec %d: value at the limit was not decoded: %v", codec, err)
+		}
+		if _, err := readValue(bufio.NewReader(bytes.NewReader(data)), nil, len(value)-1); err != ErrValueTooLarge {
+			t.Errorf("Codec %d: expected ErrValueTooLarge, got %v", codec, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ImportBatchSize is the number of entries Import writes at once.
+const ImportBatchSize = 100
+
+// ErrMalformedExport is returned by Import for lines that are not entries.
+var ErrMalformedExport = errors.New("malformed export")
+
+// ExportedEntry is a line of an export. Exports are JSON Lines with one
+// key/value pair per line.
+type ExportedEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Source is a database that can be exported: a Db or a sharded one.
+type Source interface {
+	Keys() ([]string, error)
+	GetContext(ctx context.Context, key string) (string, error)
+}
+
+// Export writes all live keys of db to w and returns their number. Keys
+// written or deleted while the export runs may or may not be included.
+func Export(ctx context.Context, w io.Writer, db Source) (int, error) {
+	keys, err := db.Keys()
+	if err != nil {
+		return 0, err
+	}
+	enc := json.NewEncoder(w)
+	n := 0
+	for _, key := range keys {
+		value, err := db.GetContext(ctx, key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := enc.Encode(ExportedEntry{Key: key, Value: value}); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Import reads an export from r and writes it with put in batches of
+// ImportBatchSize entries. Lines longer than maxLineSize bytes are rejected
+// with bufio.ErrTooLong. It returns the number of entries written; the
+// batches written before an error stay written.
+func Import(ctx context.Context, r io.Reader, maxLineSize int, put func(context.Context, []*Entry) error) (int, error) {
+	// The scanner accepts lines as long as its initial buffer, so the buffer
+	// must not be larger than the limit.
+	initial := bufSize
+	if initial > maxLineSize {
+		initial = maxLineSize
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, initial), maxLineSize)
+	n := 0
+	batch := make([]*Entry, 0, ImportBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := put(ctx, batch); err != nil {
+			return err
+		}
+		n += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e ExportedEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return n, fmt.Errorf("%w: line %d: %v", ErrMalformedExport, line, err)
+		}
+		if e.Key == "" {
+			return n, fmt.Errorf("%w: line %d: key is empty", ErrMalformedExport, line)
+		}
+		batch = append(batch, NewEntry(e.Key, e.Value))
+		if len(batch) == ImportBatchSize {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return n, err
+	}
+	return n, flush()
+}
@@ -0,0 +1,82 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"src", "dst"} {
+		if err := os.Mkdir(dir+"/"+name, 0o700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src, err := NewDb(dir+"/src", 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	dst, err := NewDb(dir+"/dst", 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	total := ImportBatchSize + 20
+	for i := 0; i < total; i++ {
+		if err := src.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf("value\n%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.Delete("key-0"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := Export(context.Background(), &buf, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != total-1 || strings.Count(buf.String(), "\n") != n {
+		t.Errorf("Expected %d exported lines, got %d: %q", total-1, n, buf.String())
+	}
+
+	n, err = Import(context.Background(), &buf, 1<<10, dst.PutMany)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != total-1 {
+		t.Errorf("Expected %d imported entries, got %d", total-1, n)
+	}
+	if value, err := dst.Get("key-7"); err != nil || value != "value\n7" {
+		t.Errorf("Unexpected imported value %q: %v", value, err)
+	}
+	if _, err := dst.Get("key-0"); err != ErrNotFound {
+		t.Errorf("Deleted key was imported: %v", err)
+	}
+
+	t.Run("invalid input", func(t *testing.T) {
+		for _, input := range []string{`{"key":"a","value":"b"}` + "\n{", `{"value":"b"}`} {
+			if _, err := Import(context.Background(), strings.NewReader(input), 1<<10, dst.PutMany); err == nil {
+				t.Errorf("Expected an error importing %q", input)
+			}
+		}
+		long := `{"key":"a","value":"` + strings.Repeat("v", 100) + `"}`
+		if _, err := Import(context.Background(), strings.NewReader(long), 64, dst.PutMany); !errors.Is(err, bufio.ErrTooLong) {
+			t.Errorf("Expected bufio.ErrTooLong, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package datastore
+
+import (
+	"hash/fnv"
+	"unsafe"
+)
+
+// IndexMode selects how segments keep their in-memory key index.
+type IndexMode int
+
+const (
+	// IndexModeHash keeps full key strings as map keys. Lookups never touch
+	// the disk, but every key is held in memory.
+	IndexModeHash IndexMode = iota
+	// IndexModeCompact keys the index by a 64-bit hash of the key. Hash
+	// collisions are resolved by reading the key back from the segment file.
+	IndexModeCompact
+)
+
+const (
+	stringHeaderSize = int64(unsafe.Sizeof(""))
+	positionSize     = int64(unsafe.Sizeof(int64(0)))
+	hashSize         = int64(unsafe.Sizeof(uint64(0)))
+)
+
+// keyReader returns the key of the record stored at the given position.
+type keyReader func(position int64) (string, error)
+
+type keyIndex interface {
+	get(key string, keyAt keyReader) (int64, bool)
+	set(key string, position int64, keyAt keyReader)
+	forEach(fn func(position int64))
+	len() int
+	memoryUsage() int64
+}
+
+func newIndex(mode IndexMode) keyIndex {
+	if mode == IndexModeCompact {
+		return &compactIndex{
+			positions:  make(map[uint64]int64),
+			collisions: make(map[uint64][]int64),
+		}
+	}
+	return make(hashIndex)
+}
+
+func (h hashIndex) get(key string, _ keyReader) (int64, bool) {
+	pos, ok := h[key]
+	return pos, ok
+}
+
+func (h hashIndex) set(key string, position int64, _ keyReader) {
+	h[key] = position
+}
+
+func (h hashIndex) forEach(fn func(position int64)) {
+	for _, pos := range h {
+		fn(pos)
+	}
+}
+
+func (h hashIndex) len() int {
+	return len(h)
+}
+
+func (h hashIndex) memoryUsage() int64 {
+	var total int64
+	for key := range h {
+		total += stringHeaderSize + int64(len(key)) + positionSize
+	}
+	return total
+}
+
+// compactIndex stores only a hash of every key. Keys whose hashes collide
+// are moved to the collisions map, where each candidate position is checked
+// against the key stored on disk.
+type compactIndex struct {
+	positions  map[uint64]int64
+	collisions map[uint64][]int64
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func (c *compactIndex) get(key string, keyAt keyReader) (int64, bool) {
+	h := hashKey(key)
+	if pos, ok := c.positions[h]; ok {
+		if k, err := keyAt(pos); err == nil && k == key {
+			return pos, true
+		}
+		return 0, false
+	}
+	candidates := c.collisions[h]
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if k, err := keyAt(candidates[i]); err == nil && k == key {
+			return candidates[i], true
+		}
+	}
+	return 0, false
+}
+
+func (c *compactIndex) set(key string, position int64, keyAt keyReader) {
+	h := hashKey(key)
+	if candidates, ok := c.collisions[h]; ok {
+		for i, pos := range candidates {
+			if k, err := keyAt(pos); err == nil && k == key {
+				candidates[i] = position
+				return
+			}
+		}
+		c.collisions[h] = append(candidates, position)
+		return
+	}
+	if pos, ok := c.positions[h]; ok {
+		if k, err := keyAt(pos); err != nil || k != key {
+			delete(c.positions, h)
+			c.collisions[h] = []int64{pos, position}
+			return
+		}
+	}
+	c.positions[h] = position
+}
+
+func (c *compactIndex) forEach(fn func(position int64)) {
+	for _, pos := range c.positions {
+		fn(pos)
+	}
+	for _, candidates := range c.collisions {
+		for _, pos := range candidates {
+			fn(pos)
+		}
+	}
+}
+
+func (c *compactIndex) len() int {
+	n := len(c.positions)
+	for _, candidates := range c.collisions {
+		n += len(candidates)
+	}
+	return n
+}
+
+func (c *compactIndex) memoryUsage() int64 {
+	total := int64(len(c.positions)) * (hashSize + positionSize)
+	for _, candidates := range c.collisions {
+		total += hashSize + int64(cap(candidates))*positionSize
+	}
+	return total
+}
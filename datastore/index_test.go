@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCompactIndex_Collisions(t *testing.T) {
+	keys := map[int64]string{0: "a", 10: "b", 20: "a"}
+	keyAt := func(position int64) (string, error) {
+		key, ok := keys[position]
+		if !ok {
+			return "", fmt.Errorf("no record at %d", position)
+		}
+		return key, nil
+	}
+
+	index := newIndex(IndexModeCompact).(*compactIndex)
+	index.set("a", 0, keyAt)
+
+	// Pretend "b" hashes to the same value as "a" by pointing its hash at the record of "a".
+	hb := hashKey("b")
+	index.positions[hb] = 0
+	if _, ok := index.get("b", keyAt); ok {
+		t.Error("Expected a colliding key to be resolved as missing")
+	}
+
+	index.set("b", 10, keyAt)
+	if pos, ok := index.get("b", keyAt); !ok || pos != 10 {
+		t.Errorf("Expected b at 10, got %d (found: %t)", pos, ok)
+	}
+	if len(index.collisions[hb]) != 2 {
+		t.Errorf("Expected 2 collision candidates, got %d", len(index.collisions[hb]))
+	}
+
+	index.set("a", 20, keyAt)
+	if pos, ok := index.get("a", keyAt); !ok || pos != 20 {
+		t.Errorf("Expected a at 20, got %d (found: %t)", pos, ok)
+	}
+}
+
+func TestIndex_MemoryUsage(t *testing.T) {
+	hash := newIndex(IndexModeHash)
+	compact := newIndex(IndexModeCompact)
+	keyAt := func(int64) (string, error) { return "", nil }
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("some-rather-long-key-%d", i)
+		hash.set(key, int64(i), keyAt)
+		compact.set(key, int64(i), func(int64) (string, error) { return key, nil })
+	}
+
+	if hash.len() != 1000 || compact.len() != 1000 {
+		t.Fatalf("Expected 1000 keys, got %d and %d", hash.len(), compact.len())
+	}
+	if compact.memoryUsage() >= hash.memoryUsage() {
+		t.Errorf("Expected compact index to use less memory: %d >= %d", compact.memoryUsage(), hash.memoryUsage())
+	}
+}
@@ -0,0 +1,72 @@
+package datastore
+
+const (
+	DefaultMaxKeySize   = 64 << 10
+	DefaultMaxValueSize = 64 << 20
+	DefaultWatchHistory = 1024
+	// DefaultWatchHistoryBytes bounds the memory held by the watch history,
+	// as a few large values would otherwise fill it.
+	DefaultWatchHistoryBytes = 16 << 20
+)
+
+// Option configures optional behaviour of a Db created by NewDb.
+type Option func(db *Db)
+
+// WithIndexMode selects the in-memory index implementation used by every
+// segment of the database. IndexModeHash is used by default.
+func WithIndexMode(mode IndexMode) Option {
+	return func(db *Db) {
+		db.indexMode = mode
+	}
+}
+
+// WithCompression compresses values of at least threshold bytes with codec.
+// Smaller values, and values that do not shrink, are stored uncompressed.
+func WithCompression(codec Codec, threshold int) Option {
+	return func(db *Db) {
+		db.compression = codec
+		db.compressionMin = threshold
+	}
+}
+
+// WithEncryption seals every record written to disk with the current key of
+// keys. Compaction rewrites live records with the current key, so records
+// sealed with older keys disappear over time.
+func WithEncryption(keys *Keyring) Option {
+	return func(db *Db) {
+		db.keys = keys
+	}
+}
+
+// WithMaxKeySize limits the size of keys accepted by Put.
+func WithMaxKeySize(size int) Option {
+	return func(db *Db) {
+		db.maxKeySize = size
+	}
+}
+
+// WithMaxValueSize limits the size of values accepted by Put. Compressed values
+// are decompressed up to this size, so stored compressed values larger than a
+// lowered limit can no longer be read. The database still opens, and
+// compaction keeps them as they are.
+func WithMaxValueSize(size int) Option {
+	return func(db *Db) {
+		db.maxValueSize = size
+	}
+}
+
+// WithWatchHistory sets how many recent events are kept in memory for
+// watchers resuming with WatchFrom.
+func WithWatchHistory(size int) Option {
+	return func(db *Db) {
+		db.historySize = size
+	}
+}
+
+// WithWatchHistoryBytes limits the total size of the keys and values of the
+// events kept for WatchFrom. The oldest events are dropped first.
+func WithWatchHistoryBytes(size int) Option {
+	return func(db *Db) {
+		db.historyMaxBytes = size
+	}
+}
@@ -0,0 +1,70 @@
+package sharded
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// virtualNodes is the number of points every member owns on the hash ring.
+// More points spread the keys more evenly between the members.
+const virtualNodes = 128
+
+// Ring maps keys to members by consistent hashing. A key belongs to the
+// member owning the first point at or after the hash of the key. Adding a
+// member only moves keys to the new member.
+type Ring struct {
+	points []uint64
+	owners map[uint64]int
+}
+
+// NewRing places the members on a ring. Points are derived from the member
+// names, so every process building a ring of the same members routes keys
+// the same way.
+func NewRing(members ...string) *Ring {
+	r := &Ring{owners: make(map[uint64]int, len(members)*virtualNodes)}
+	for i, member := range members {
+		for v := 0; v < virtualNodes; v++ {
+			point := hash(member + "-" + strconv.Itoa(v))
+			if _, taken := r.owners[point]; taken {
+				continue
+			}
+			r.owners[point] = i
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+func newShardRing(shards int) *Ring {
+	members := make([]string, shards)
+	for i := range members {
+		members[i] = "shard-" + strconv.Itoa(i)
+	}
+	return NewRing(members...)
+}
+
+// Locate returns the index of the member that owns key.
+func (r *Ring) Locate(key string) int {
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// hash is FNV-64a followed by a finalizer, as FNV alone leaves similar short
+// strings close to each other.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
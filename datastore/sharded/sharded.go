@@ -0,0 +1,321 @@
+// Package sharded spreads keys over several datastore.Db instances, each
+// stored in its own directory, so that one store can use several disks.
+package sharded
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+)
+
+// shardsFileName records the directories of the shards of a store, one per
+// line in the order of the shards. Keys are routed by the number of shards,
+// so a store cannot be reopened with other directories. Directories inside
+// the store directory are recorded relative to it, so the store may be moved.
+const shardsFileName = "shards"
+
+// Db routes every key to one of its shards by consistent hashing. Shards
+// write and compact their segments independently of each other, their
+// changes are watched together.
+type Db struct {
+	shards []*datastore.Db
+	ring   *Ring
+
+	watchMutex      sync.Mutex
+	closed          bool
+	seq             uint64
+	shardSeqs       []uint64
+	watchers        map[*watcher]struct{}
+	history         []datastore.Event
+	historySize     int
+	historyBytes    int
+	historyMaxBytes int
+	relays          sync.WaitGroup
+}
+
+// ShardDir returns the default directory of the given shard of a store kept
+// in dir.
+func ShardDir(dir string, shard int) string {
+	return filepath.Join(dir, "shard-"+strconv.Itoa(shard))
+}
+
+// ShardDirs returns the default directories of the n shards of a store kept
+// in dir.
+func ShardDirs(dir string, n int) []string {
+	dirs := make([]string, n)
+	for i := range dirs {
+		dirs[i] = ShardDir(dir, i)
+	}
+	return dirs
+}
+
+// NewDb opens a store kept in dir with a shard in every one of shardDirs,
+// which may be on other disks. The shards file in dir must list the same
+// directories, it is created for a new store. Every shard is opened with the
+// given segment size and options.
+func NewDb(dir string, shardDirs []string, segmentSize int64, opts ...datastore.Option) (*Db, error) {
+	n := len(shardDirs)
+	if n < 1 {
+		return nil, fmt.Errorf("invalid number of shards: %d", n)
+	}
+	if err := checkShardDirs(dir, shardDirs); err != nil {
+		return nil, err
+	}
+
+	shards := make([]*datastore.Db, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if errs[i] = os.MkdirAll(shardDirs[i], 0o700); errs[i] != nil {
+				return
+			}
+			shards[i], errs[i] = datastore.NewDb(shardDirs[i], segmentSize, opts...)
+		}(i)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		for _, s := range shards {
+			if s != nil {
+				s.Close()
+			}
+		}
+		return nil, err
+	}
+	db := &Db{shards: shards, ring: newShardRing(n)}
+	db.startFeed()
+	return db, nil
+}
+
+func checkShardDirs(dir string, shardDirs []string) error {
+	recorded, err := recordedDirs(dir, shardDirs)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, shardsFileName)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+		return os.WriteFile(path, []byte(strings.Join(recorded, "\n")+"\n"), 0o600)
+	}
+	if err != nil {
+		return err
+	}
+
+	stored := strings.Fields(string(data))
+	// Stores created before the directories could be chosen only record
+	// the number of their shards, which are in the default directories.
+	if len(stored) == 1 {
+		if count, err := strconv.Atoi(stored[0]); err == nil {
+			stored, _ = recordedDirs(dir, ShardDirs(dir, count))
+		}
+	}
+	if strings.Join(stored, "\n") != strings.Join(recorded, "\n") {
+		return fmt.Errorf("store has %d shards in %s, cannot open it with %d in %s",
+			len(stored), strings.Join(stored, ","), len(recorded), strings.Join(recorded, ","))
+	}
+	return nil
+}
+
+// recordedDirs returns the shard directories as recorded in the shards file.
+func recordedDirs(dir string, shardDirs []string) ([]string, error) {
+	base, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	recorded := make([]string, len(shardDirs))
+	seen := make(map[string]bool, len(shardDirs))
+	for i, shardDir := range shardDirs {
+		abs, err := filepath.Abs(shardDir)
+		if err != nil {
+			return nil, err
+		}
+		if seen[abs] {
+			return nil, fmt.Errorf("shard directory %s is given twice", shardDir)
+		}
+		seen[abs] = true
+		if rel, err := filepath.Rel(base, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			abs = rel
+		}
+		if strings.ContainsAny(abs, " \t\r\n") {
+			return nil, fmt.Errorf("shard directory %q contains white space", shardDir)
+		}
+		recorded[i] = abs
+	}
+	return recorded, nil
+}
+
+// Shards returns the number of shards.
+func (db *Db) Shards() int {
+	return len(db.shards)
+}
+
+// Shard returns the shard that stores key.
+func (db *Db) Shard(key string) int {
+	return db.ring.Locate(key)
+}
+
+func (db *Db) shardOf(key string) *datastore.Db {
+	return db.shards[db.ring.Locate(key)]
+}
+
+func (db *Db) Get(key string) (string, error) {
+	return db.shardOf(key).Get(key)
+}
+
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	return db.shardOf(key).GetContext(ctx, key)
+}
+
+func (db *Db) GetRecordContext(ctx context.Context, key string) (*datastore.Record, error) {
+	return db.shardOf(key).GetRecordContext(ctx, key)
+}
+
+func (db *Db) Put(key, value string) error {
+	return db.shardOf(key).Put(key, value)
+}
+
+func (db *Db) PutContext(ctx context.Context, key, value string) error {
+	return db.shardOf(key).PutContext(ctx, key, value)
+}
+
+func (db *Db) Delete(key string) error {
+	return db.shardOf(key).Delete(key)
+}
+
+func (db *Db) DeleteContext(ctx context.Context, key string) error {
+	return db.shardOf(key).DeleteContext(ctx, key)
+}
+
+// GetMany reads the keys of every shard concurrently and returns the values
+// of the keys that exist.
+func (db *Db) GetMany(ctx context.Context, keys []string) (map[string]string, error) {
+	byShard := make([][]string, len(db.shards))
+	for _, key := range keys {
+		i := db.ring.Locate(key)
+		byShard[i] = append(byShard[i], key)
+	}
+
+	results := make([]map[string]string, len(db.shards))
+	errs := make([]error, len(db.shards))
+	var wg sync.WaitGroup
+	for i, shardKeys := range byShard {
+		if len(shardKeys) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, shardKeys []string) {
+			defer wg.Done()
+			results[i], errs[i] = db.shards[i].GetMany(ctx, shardKeys)
+		}(i, shardKeys)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(keys))
+	for _, r := range results {
+		for key, value := range r {
+			values[key] = value
+		}
+	}
+	return values, nil
+}
+
+// PutMany writes the entries of every shard concurrently. Entries of the
+// same shard are written in order.
+func (db *Db) PutMany(ctx context.Context, entries []*datastore.Entry) error {
+	byShard := make([][]*datastore.Entry, len(db.shards))
+	for _, e := range entries {
+		i := db.ring.Locate(e.Key())
+		byShard[i] = append(byShard[i], e)
+	}
+
+	errs := make([]error, len(db.shards))
+	var wg sync.WaitGroup
+	for i, shardEntries := range byShard {
+		if len(shardEntries) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, shardEntries []*datastore.Entry) {
+			defer wg.Done()
+			errs[i] = db.shards[i].PutMany(ctx, shardEntries)
+		}(i, shardEntries)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Keys returns the live keys of all shards.
+func (db *Db) Keys() ([]string, error) {
+	var keys []string
+	for _, s := range db.shards {
+		shardKeys, err := s.Keys()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, shardKeys...)
+	}
+	return keys, nil
+}
+
+// Stats returns the combined statistics of all shards.
+func (db *Db) Stats() datastore.Stats {
+	return datastore.MergeStats(db.ShardStats()...)
+}
+
+// ShardStats returns the statistics of every shard.
+func (db *Db) ShardStats() []datastore.Stats {
+	stats := make([]datastore.Stats, len(db.shards))
+	for i, s := range db.shards {
+		stats[i] = s.Stats()
+	}
+	return stats
+}
+
+// Degraded returns the write error of the first shard that switched to
+// read-only mode, or nil if all shards accept writes.
+func (db *Db) Degraded() error {
+	for i, s := range db.shards {
+		if err := s.Degraded(); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Close closes all shards and stops the watchers once the events of the
+// shards have been relayed.
+func (db *Db) Close() error {
+	db.watchMutex.Lock()
+	db.closed = true
+	db.watchMutex.Unlock()
+
+	errs := make([]error, len(db.shards))
+	var wg sync.WaitGroup
+	for i, s := range db.shards {
+		wg.Add(1)
+		go func(i int, s *datastore.Db) {
+			defer wg.Done()
+			errs[i] = s.Close()
+		}(i, s)
+	}
+	wg.Wait()
+	db.relays.Wait()
+	db.stopWatchers()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,286 @@
+package sharded
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+)
+
+func TestRing_Balance(t *testing.T) {
+	r := newShardRing(4)
+	counts := make([]int, 4)
+	for i := 0; i < 10000; i++ {
+		counts[r.Locate(fmt.Sprintf("key-%d", i))]++
+	}
+	for shard, n := range counts {
+		if n < 1500 || n > 3500 {
+			t.Errorf("Shard %d got %d of 10000 keys", shard, n)
+		}
+	}
+}
+
+func TestRing_AddShardMovesFewKeys(t *testing.T) {
+	before, after := newShardRing(4), newShardRing(5)
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if s := before.Locate(key); s != after.Locate(key) {
+			if after.Locate(key) != 4 {
+				t.Fatalf("Key %s moved between old shards", key)
+			}
+			moved++
+		}
+	}
+	if moved > 3000 {
+		t.Errorf("Adding a shard moved %d of 10000 keys", moved)
+	}
+}
+
+func TestDb(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test-sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, ShardDirs(dir, 3), 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key-0"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("route keys to shards", func(t *testing.T) {
+		for i := 1; i < 30; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			if value, err := db.shards[db.Shard(key)].Get(key); err != nil || value != fmt.Sprintf("value-%d", i) {
+				t.Errorf("Key %s is not stored in its shard: %v", key, err)
+			}
+		}
+		if _, err := db.Get("key-0"); err != datastore.ErrNotFound {
+			t.Errorf("Expected ErrNotFound for a deleted key, got %v", err)
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		err := db.PutMany(context.Background(), []*datastore.Entry{
+			datastore.NewEntry("key-1", "batch-1"),
+			datastore.NewEntry("key-2", "batch-2"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, err := db.GetMany(context.Background(), []string{"key-0", "key-1", "key-2", "key-3"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]string{"key-1": "batch-1", "key-2": "batch-2", "key-3": "value-3"}
+		if fmt.Sprint(values) != fmt.Sprint(expected) {
+			t.Errorf("Expected %v, got %v", expected, values)
+		}
+	})
+
+	t.Run("combine shards", func(t *testing.T) {
+		keys, err := db.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 29 {
+			t.Errorf("Expected 29 keys, got %d", len(keys))
+		}
+		st := db.Stats()
+		if st.LiveKeys != 29 || st.Put.Count != 33 {
+			t.Errorf("Unexpected combined stats: %+v", st)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewDb(dir, ShardDirs(dir, 4), 1<<10); err == nil {
+			t.Error("Expected an error when reopening with another number of shards")
+		}
+		dirs := ShardDirs(dir, 3)
+		dirs[0], dirs[1] = dirs[1], dirs[0]
+		if _, err := NewDb(dir, dirs, 1<<10); err == nil {
+			t.Error("Expected an error when reopening with the shards in another order")
+		}
+		db, err = NewDb(dir, ShardDirs(dir, 3), 1<<10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		keys, err := db.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		if len(keys) != 29 || !strings.HasPrefix(keys[0], "key-1") {
+			t.Errorf("Unexpected keys after reopening: %v", keys)
+		}
+	})
+}
+
+func TestDb_ShardDirs(t *testing.T) {
+	dir := t.TempDir()
+	disks := []string{t.TempDir(), t.TempDir()}
+
+	if _, err := NewDb(dir, []string{disks[0], disks[0]}, 1<<10); err == nil {
+		t.Error("Expected an error for a directory given twice")
+	}
+	db, err := NewDb(dir, disks, 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, disk := range disks {
+		if entries, err := os.ReadDir(disk); err != nil || len(entries) == 0 {
+			t.Errorf("Expected segments in %s: %v", disk, err)
+		}
+	}
+
+	if _, err := NewDb(dir, ShardDirs(dir, 2), 1<<10); err == nil {
+		t.Error("Expected an error when reopening with other directories")
+	}
+	db, err = NewDb(dir, disks, 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if keys, err := db.Keys(); err != nil || len(keys) != 10 {
+		t.Errorf("Expected 10 keys after reopening, got %d: %v", len(keys), err)
+	}
+}
+
+func TestDb_LegacyShardsFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, shardsFileName), []byte("2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDb(dir, ShardDirs(dir, 3), 1<<10); err == nil {
+		t.Error("Expected an error when reopening with another number of shards")
+	}
+	db, err := NewDb(dir, ShardDirs(dir, 2), 1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDb_Watch(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, ShardDirs(dir, 3), 1<<10, datastore.WithWatchHistory(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, stop := db.Watch("a/")
+	defer stop()
+
+	// The keys are spread over the shards, the events of all of them are
+	// numbered in one sequence.
+	for i := 0; i < 6; i++ {
+		if err := db.Put(fmt.Sprintf("a/%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("b/0", "skipped"); err != nil {
+		t.Fatal(err)
+	}
+	// Events of different shards are relayed in any order.
+	seen := make(map[uint64]string)
+	for i := 0; i < 6; i++ {
+		e := <-events
+		if e.Seq < 1 || e.Seq > 7 || e.Type != datastore.EventPut {
+			t.Errorf("Unexpected event %+v", e)
+		}
+		seen[e.Seq] = e.Key
+	}
+	if len(seen) != 6 {
+		t.Errorf("Expected a sequence number for every key, got %v", seen)
+	}
+	for db.LastSeq() != 7 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := db.Delete("a/0"); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-events; e.Seq != 8 || e.Type != datastore.EventDelete || e.Key != "a/0" {
+		t.Errorf("Unexpected event %+v", e)
+	}
+	if seq := db.LastSeq(); seq != 8 {
+		t.Errorf("Expected the last sequence number 8, got %d", seq)
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		replayed, stop, err := db.WatchFrom("", 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stop()
+		for seq := uint64(6); seq <= 8; seq++ {
+			if e := <-replayed; e.Seq != seq {
+				t.Errorf("Expected event %d, got %+v", seq, e)
+			}
+		}
+		if _, _, err := db.WatchFrom("", 3); err != datastore.ErrHistoryLost {
+			t.Errorf("Expected ErrHistoryLost, got %v", err)
+		}
+	})
+
+	t.Run("lost events of a shard", func(t *testing.T) {
+		watched, stop := db.Watch("")
+		defer stop()
+		db.publish(0, datastore.Event{Seq: db.shardSeqs[0] + 3, Type: datastore.EventPut, Key: "c/0"})
+		if _, ok := <-watched; ok {
+			t.Error("Expected the watcher to be dropped")
+		}
+		if seq := db.LastSeq(); seq != 11 {
+			t.Errorf("Expected the lost events to be counted, got %d", seq)
+		}
+		if _, _, err := db.WatchFrom("", 9); err != datastore.ErrHistoryLost {
+			t.Errorf("Expected ErrHistoryLost, got %v", err)
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		events, _ := db.Watch("")
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := <-events; ok {
+			t.Error("Expected the watchers to be stopped on close")
+		}
+		db, err := NewDb(dir, ShardDirs(dir, 3), 1<<10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		// The shards count 8 writes, the lost events were made up.
+		if seq := db.LastSeq(); seq != 8 {
+			t.Errorf("Expected the sequence number to survive reopening, got %d", seq)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package sharded
+
+import (
+	"strings"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+)
+
+// watcherBuffer is the number of events a watcher may fall behind before it
+// is dropped.
+const watcherBuffer = 256
+
+// The shards number their writes independently, so the events of all shards
+// are relayed into one feed and numbered again in the order they arrive.
+// Every write advances the sequence number of one shard by one, so the
+// sequence number of the store is the sum of those of its shards and
+// survives restarts like that of a single datastore.Db.
+
+type watcher struct {
+	prefix string
+	events chan datastore.Event
+}
+
+// startFeed subscribes to the events of every shard. It is called before the
+// store is used, so no write is missed.
+func (db *Db) startFeed() {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+
+	db.watchers = make(map[*watcher]struct{})
+	db.historySize, db.historyMaxBytes = db.shards[0].WatchHistory()
+	db.shardSeqs = make([]uint64, len(db.shards))
+	for i, s := range db.shards {
+		db.shardSeqs[i] = s.LastSeq()
+		db.seq += db.shardSeqs[i]
+	}
+	for i := range db.shards {
+		events := db.subscribe(i)
+		db.relays.Add(1)
+		go db.relay(i, events)
+	}
+}
+
+// subscribe watches the keys of shard i written after the last event relayed
+// from it. If these events are no longer kept by the shard, publish notices
+// the gap. The caller must hold watchMutex.
+func (db *Db) subscribe(i int) <-chan datastore.Event {
+	events, _, err := db.shards[i].WatchFrom("", db.shardSeqs[i])
+	if err != nil {
+		events, _ = db.shards[i].Watch("")
+	}
+	return events
+}
+
+// relay publishes the events of shard i until the store is closed. The shard
+// drops a relay that falls behind, which then subscribes again.
+func (db *Db) relay(i int, events <-chan datastore.Event) {
+	defer db.relays.Done()
+	for {
+		for e := range events {
+			db.publish(i, e)
+		}
+		db.watchMutex.Lock()
+		// The store is marked closed before its shards, so a relay never
+		// subscribes to a closed shard.
+		if db.closed {
+			db.watchMutex.Unlock()
+			return
+		}
+		events = db.subscribe(i)
+		db.watchMutex.Unlock()
+	}
+}
+
+// Watch subscribes to changes of the keys starting with prefix in all
+// shards. Events are delivered on the returned channel until stop is called
+// or the store is closed. A watcher that does not keep up with the writes is
+// dropped and its channel is closed, so it can resume with WatchFrom.
+func (db *Db) Watch(prefix string) (events <-chan datastore.Event, stop func()) {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+	return db.addWatcher(prefix, nil)
+}
+
+// WatchFrom is like Watch but first replays the recent events with sequence
+// numbers greater than seq. It returns datastore.ErrHistoryLost if some of
+// these events are no longer kept in memory.
+func (db *Db) WatchFrom(prefix string, seq uint64) (events <-chan datastore.Event, stop func(), err error) {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+
+	if seq < db.seq && (len(db.history) == 0 || db.history[0].Seq > seq+1) {
+		return nil, nil, datastore.ErrHistoryLost
+	}
+	var replay []datastore.Event
+	for _, e := range db.history {
+		if e.Seq > seq && strings.HasPrefix(e.Key, prefix) {
+			replay = append(replay, e)
+		}
+	}
+	events, stop = db.addWatcher(prefix, replay)
+	return events, stop, nil
+}
+
+// LastSeq returns the sequence number of the latest relayed write.
+func (db *Db) LastSeq() uint64 {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+	return db.seq
+}
+
+func (db *Db) addWatcher(prefix string, replay []datastore.Event) (<-chan datastore.Event, func()) {
+	w := &watcher{
+		prefix: prefix,
+		events: make(chan datastore.Event, watcherBuffer+len(replay)),
+	}
+	for _, e := range replay {
+		w.events <- e
+	}
+	db.watchers[w] = struct{}{}
+
+	stop := func() {
+		db.watchMutex.Lock()
+		defer db.watchMutex.Unlock()
+		db.removeWatcher(w)
+	}
+	return w.events, stop
+}
+
+func (db *Db) removeWatcher(w *watcher) {
+	if _, ok := db.watchers[w]; ok {
+		delete(db.watchers, w)
+		close(w.events)
+	}
+}
+
+// publish numbers an event of shard i in the feed of the store and notifies
+// the watchers.
+func (db *Db) publish(i int, e datastore.Event) {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+
+	last := db.shardSeqs[i]
+	if e.Seq <= last {
+		// Replayed by the shard after the relay subscribed again.
+		return
+	}
+	if e.Seq > last+1 {
+		// Events of the shard were lost while the relay subscribed again.
+		// They are counted, and the watchers and the history, which would
+		// skip them, are dropped.
+		db.seq += e.Seq - last - 1
+		db.history = nil
+		db.historyBytes = 0
+		for w := range db.watchers {
+			db.removeWatcher(w)
+		}
+	}
+	db.shardSeqs[i] = e.Seq
+	db.seq++
+	e.Seq = db.seq
+
+	if db.historySize > 0 {
+		db.history = append(db.history, e)
+		db.historyBytes += len(e.Key) + len(e.Value)
+		db.trimHistory()
+	}
+	for w := range db.watchers {
+		if !strings.HasPrefix(e.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- e:
+		default:
+			db.removeWatcher(w)
+		}
+	}
+}
+
+// trimHistory drops the oldest events until the history fits both its
+// number of events and its size in bytes. The caller must hold watchMutex.
+func (db *Db) trimHistory() {
+	drop := 0
+	for drop < len(db.history) && (len(db.history)-drop > db.historySize || db.historyBytes > db.historyMaxBytes) {
+		db.historyBytes -= len(db.history[drop].Key) + len(db.history[drop].Value)
+		drop++
+	}
+	if drop == 0 {
+		return
+	}
+	n := copy(db.history, db.history[drop:])
+	for i := n; i < len(db.history); i++ {
+		db.history[i] = datastore.Event{}
+	}
+	db.history = db.history[:n]
+}
+
+func (db *Db) stopWatchers() {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+	for w := range db.watchers {
+		db.removeWatcher(w)
+	}
+}
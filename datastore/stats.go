@@ -0,0 +1,126 @@
+package datastore
+
+import (
+	"time"
+)
+
+// Stats is a snapshot of the state of a Db.
+type Stats struct {
+	Segments         int          `json:"segments"`
+	DiskBytes        int64        `json:"disk_bytes"`
+	LiveKeys         int64        `json:"live_keys"`
+	LiveBytes        int64        `json:"live_bytes"`
+	GarbageRatio     float64      `json:"garbage_ratio"`
+	IndexMemoryBytes int64        `json:"index_memory_bytes"`
+	CompactionRuns   int64        `json:"compaction_runs"`
+	Put              LatencyStats `json:"put"`
+	Get              LatencyStats `json:"get"`
+}
+
+// LatencyStats summarises the duration of the operations of one kind.
+type LatencyStats struct {
+	Count int64         `json:"count"`
+	Total time.Duration `json:"total_ns"`
+	Max   time.Duration `json:"max_ns"`
+}
+
+func (l *LatencyStats) observe(d time.Duration) {
+	l.Count++
+	l.Total += d
+	if d > l.Max {
+		l.Max = d
+	}
+}
+
+func (l *LatencyStats) merge(other LatencyStats) {
+	l.Count += other.Count
+	l.Total += other.Total
+	if other.Max > l.Max {
+		l.Max = other.Max
+	}
+}
+
+// Stats returns the current statistics of the database. Live keys and bytes
+// are maintained on every write, so the call does not scan the segments.
+func (db *Db) Stats() Stats {
+	db.indexMutex.Lock()
+	st := Stats{Segments: len(db.segments)}
+	for _, s := range db.segments {
+		st.DiskBytes += s.outOffset
+		st.IndexMemoryBytes += s.index.memoryUsage()
+	}
+	db.indexMutex.Unlock()
+
+	db.statsMutex.Lock()
+	st.LiveKeys = db.liveKeys
+	st.LiveBytes = db.liveBytes
+	st.CompactionRuns = db.compactionRuns
+	st.Put = db.putLatency
+	st.Get = db.getLatency
+	db.statsMutex.Unlock()
+
+	st.GarbageRatio = garbageRatio(st.LiveBytes, st.DiskBytes)
+	return st
+}
+
+// MergeStats combines the statistics of several databases, for example the
+// shards of one store, into one.
+func MergeStats(stats ...Stats) Stats {
+	var total Stats
+	for _, st := range stats {
+		total.Segments += st.Segments
+		total.DiskBytes += st.DiskBytes
+		total.LiveKeys += st.LiveKeys
+		total.LiveBytes += st.LiveBytes
+		total.IndexMemoryBytes += st.IndexMemoryBytes
+		total.CompactionRuns += st.CompactionRuns
+		total.Put.merge(st.Put)
+		total.Get.merge(st.Get)
+	}
+	total.GarbageRatio = garbageRatio(total.LiveBytes, total.DiskBytes)
+	return total
+}
+
+func garbageRatio(liveBytes, diskBytes int64) float64 {
+	if diskBytes > 0 && liveBytes < diskBytes {
+		return 1 - float64(liveBytes)/float64(diskBytes)
+	}
+	return 0
+}
+
+func (db *Db) observeLatency(l *LatencyStats, start time.Time) {
+	d := time.Since(start)
+	db.statsMutex.Lock()
+	l.observe(d)
+	db.statsMutex.Unlock()
+}
+
+// liveRecordSize returns the size of the newest record of key, or 0 if the
+// key is missing or deleted. The caller must hold indexMutex.
+func (db *Db) liveRecordSize(key string) int64 {
+	s, pos, err := db.getSegmentAndPos(key)
+	if err != nil {
+		return 0
+	}
+	header, err := s.getRecordHeader(pos)
+	if err != nil || header.deleted {
+		return 0
+	}
+	return header.size
+}
+
+// trackWrite accounts for a record of the given size replacing a live record
+// of prevSize bytes, if any.
+func (db *Db) trackWrite(prevSize, size int64, deleted bool) {
+	db.statsMutex.Lock()
+	defer db.statsMutex.Unlock()
+
+	if prevSize > 0 {
+		db.liveKeys--
+		db.liveBytes -= prevSize
+	}
+	if !deleted {
+		db.liveKeys++
+		db.liveBytes += size
+	}
+}
@@ -0,0 +1,115 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDb_Stats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops := [][]string{
+		{"key1", "value1"},
+		{"key2", "value2"},
+		{"key1", "value11"},
+		{"key2", deleteMarker},
+	}
+	var diskBytes int64
+	for _, op := range ops {
+		if err := db.Put(op[0], op[1]); err != nil {
+			t.Fatal(err)
+		}
+		diskBytes += NewEntry(op[0], op[1]).GetLength()
+	}
+	if _, err := db.Get("key1"); err != nil {
+		t.Fatal(err)
+	}
+	liveBytes := NewEntry("key1", "value11").GetLength()
+
+	check := func(t *testing.T, st Stats) {
+		if st.Segments != 1 {
+			t.Errorf("Expected 1 segment, got %d", st.Segments)
+		}
+		if st.DiskBytes != diskBytes {
+			t.Errorf("Expected %d bytes on disk, got %d", diskBytes, st.DiskBytes)
+		}
+		if st.LiveKeys != 1 {
+			t.Errorf("Expected 1 live key, got %d", st.LiveKeys)
+		}
+		if st.LiveBytes != liveBytes {
+			t.Errorf("Expected %d live bytes, got %d", liveBytes, st.LiveBytes)
+		}
+		expectedRatio := 1 - float64(liveBytes)/float64(diskBytes)
+		if st.GarbageRatio != expectedRatio {
+			t.Errorf("Expected garbage ratio %f, got %f", expectedRatio, st.GarbageRatio)
+		}
+	}
+
+	t.Run("after writes", func(t *testing.T) {
+		st := db.Stats()
+		check(t, st)
+		if st.Put.Count != int64(len(ops)) || st.Get.Count != 1 {
+			t.Errorf("Unexpected operation counts: %d puts, %d gets", st.Put.Count, st.Get.Count)
+		}
+		if st.Put.Total <= 0 || st.Put.Max <= 0 || st.Put.Max > st.Put.Total {
+			t.Errorf("Unexpected put latency: %+v", st.Put)
+		}
+	})
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("after recovery", func(t *testing.T) {
+		db, err := NewDb(dir, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		check(t, db.Stats())
+	})
+}
+
+func TestDb_StatsCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	length := NewEntry("k1", "vv").GetLength()
+	db, err := NewDb(dir, 2*length)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"k1", "k1", "k1", "k2", "k3"} {
+		if err := db.Put(key, "vv"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	st := db.Stats()
+	if st.CompactionRuns != 1 {
+		t.Errorf("Expected 1 compaction run, got %d", st.CompactionRuns)
+	}
+	if st.LiveKeys != 3 || st.LiveBytes != 3*length {
+		t.Errorf("Expected 3 live keys of %d bytes, got %d keys of %d bytes", 3*length, st.LiveKeys, st.LiveBytes)
+	}
+	if st.DiskBytes != 3*length || st.GarbageRatio != 0 {
+		t.Errorf("Expected no garbage after compaction, got %d bytes on disk, ratio %f", st.DiskBytes, st.GarbageRatio)
+	}
+}
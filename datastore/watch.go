@@ -0,0 +1,163 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	EventPut    = "put"
+	EventDelete = "delete"
+)
+
+// watcherBuffer is the number of events a watcher may fall behind before it
+// is dropped.
+const watcherBuffer = 256
+
+var (
+	ErrHistoryLost = fmt.Errorf("requested events are no longer available")
+)
+
+// Event describes a change of a key. Sequence numbers grow with every write
+// and survive restarts of the database.
+type Event struct {
+	Seq   uint64 `json:"seq"`
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+type watcher struct {
+	prefix string
+	events chan Event
+}
+
+// Watch subscribes to changes of the keys starting with prefix. Events are
+// delivered on the returned channel until stop is called or the database is
+// closed. A watcher that does not keep up with the writes is dropped and its
+// channel is closed, so it can resume with WatchFrom.
+func (db *Db) Watch(prefix string) (events <-chan Event, stop func()) {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+	return db.addWatcher(prefix, nil)
+}
+
+// WatchFrom is like Watch but first replays the recent events with sequence
+// numbers greater than seq. It returns ErrHistoryLost if some of these events
+// are no longer kept in memory.
+func (db *Db) WatchFrom(prefix string, seq uint64) (events <-chan Event, stop func(), err error) {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+
+	if seq < db.seq && (len(db.history) == 0 || db.history[0].Seq > seq+1) {
+		return nil, nil, ErrHistoryLost
+	}
+	var replay []Event
+	for _, e := range db.history {
+		if e.Seq > seq && strings.HasPrefix(e.Key, prefix) {
+			replay = append(replay, e)
+		}
+	}
+	events, stop = db.addWatcher(prefix, replay)
+	return events, stop, nil
+}
+
+// LastSeq returns the sequence number of the latest write.
+func (db *Db) LastSeq() uint64 {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+	return db.seq
+}
+
+// WatchHistory returns how many recent events are kept for WatchFrom and how
+// many bytes of keys and values they may take.
+func (db *Db) WatchHistory() (size, maxBytes int) {
+	return db.historySize, db.historyMaxBytes
+}
+
+func (db *Db) addWatcher(prefix string, replay []Event) (<-chan Event, func()) {
+	w := &watcher{
+		prefix: prefix,
+		events: make(chan Event, watcherBuffer+len(replay)),
+	}
+	for _, e := range replay {
+		w.events <- e
+	}
+	db.watchers[w] = struct{}{}
+
+	stop := func() {
+		db.watchMutex.Lock()
+		defer db.watchMutex.Unlock()
+		db.removeWatcher(w)
+	}
+	return w.events, stop
+}
+
+func (db *Db) removeWatcher(w *watcher) {
+	if _, ok := db.watchers[w]; ok {
+		delete(db.watchers, w)
+		close(w.events)
+	}
+}
+
+// publish records a successful write and notifies the watchers. It is called
+// from the put routine, so it never blocks on slow watchers.
+func (db *Db) publish(seq uint64, e *Entry) {
+	event := Event{Seq: seq, Type: EventPut, Key: e.key, Value: e.value}
+	if e.value == deleteMarker {
+		event.Type = EventDelete
+		event.Value = ""
+	}
+
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+
+	db.seq = seq
+	if db.historySize > 0 {
+		db.history = append(db.history, event)
+		db.historyBytes += eventSize(event)
+		db.trimHistory()
+	}
+	for w := range db.watchers {
+		if !strings.HasPrefix(e.key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- event:
+		default:
+			db.removeWatcher(w)
+		}
+	}
+}
+
+func eventSize(e Event) int {
+	return len(e.Key) + len(e.Value)
+}
+
+// trimHistory drops the oldest events until the history fits both its
+// number of events and its size in bytes. An event larger than the whole
+// history is dropped as well. The caller must hold watchMutex.
+func (db *Db) trimHistory() {
+	drop := 0
+	for drop < len(db.history) && (len(db.history)-drop > db.historySize || db.historyBytes > db.historyMaxBytes) {
+		db.historyBytes -= eventSize(db.history[drop])
+		drop++
+	}
+	if drop == 0 {
+		return
+	}
+	n := copy(db.history, db.history[drop:])
+	// Clear the events left behind, so their values can be collected.
+	for i := n; i < len(db.history); i++ {
+		db.history[i] = Event{}
+	}
+	db.history = db.history[:n]
+}
+
+func (db *Db) stopWatchers() {
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+	for w := range db.watchers {
+		db.removeWatcher(w)
+	}
+}
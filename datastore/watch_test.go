@@ -0,0 +1,146 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("Watch channel closed unexpectedly")
+		}
+		return e
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for an event")
+	}
+	return Event{}
+}
+
+func TestDb_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1<<20, WithWatchHistory(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, stop := db.Watch("user/")
+	if err := db.Put("user/1", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("other", "skipped"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("user/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	put := receive(t, events)
+	if put != (Event{Seq: 1, Type: EventPut, Key: "user/1", Value: "alice"}) {
+		t.Errorf("Unexpected put event: %+v", put)
+	}
+	del := receive(t, events)
+	if del != (Event{Seq: 3, Type: EventDelete, Key: "user/1"}) {
+		t.Errorf("Unexpected delete event: %+v", del)
+	}
+
+	stop()
+	if _, ok := <-events; ok {
+		t.Error("Expected the channel to be closed after stop")
+	}
+
+	t.Run("replay history", func(t *testing.T) {
+		events, stop, err := db.WatchFrom("", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stop()
+		if e := receive(t, events); e.Seq != 2 || e.Key != "other" {
+			t.Errorf("Unexpected replayed event: %+v", e)
+		}
+		if e := receive(t, events); e.Seq != 3 {
+			t.Errorf("Unexpected replayed event: %+v", e)
+		}
+		if _, _, err := db.WatchFrom("", 0); err != ErrHistoryLost {
+			t.Errorf("Expected ErrHistoryLost, got %v", err)
+		}
+	})
+
+	t.Run("sequence survives restart", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = NewDb(dir, 1<<20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if seq := db.LastSeq(); seq != 3 {
+			t.Errorf("Expected last sequence 3, got %d", seq)
+		}
+		events, stop := db.Watch("")
+		defer stop()
+		if err := db.Put("user/2", "bob"); err != nil {
+			t.Fatal(err)
+		}
+		if e := receive(t, events); e.Seq != 4 {
+			t.Errorf("Expected sequence 4 after restart, got %d", e.Seq)
+		}
+	})
+}
+
+func TestDb_WatchHistoryBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1<<20, WithWatchHistoryBytes(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	value := strings.Repeat("v", 40)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the last two events fit in 100 bytes.
+	if _, _, err := db.WatchFrom("", 0); err != ErrHistoryLost {
+		t.Errorf("Expected ErrHistoryLost, got %v", err)
+	}
+	events, stop, err := db.WatchFrom("", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := receive(t, events); e.Seq != 2 || e.Key != "b" {
+		t.Errorf("Unexpected replayed event: %+v", e)
+	}
+	stop()
+
+	// An event larger than the whole history is not kept.
+	if err := db.Put("large", strings.Repeat("v", 200)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.WatchFrom("", 3); err != ErrHistoryLost {
+		t.Errorf("Expected ErrHistoryLost, got %v", err)
+	}
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
+	if len(db.history) != 0 || db.historyBytes != 0 {
+		t.Errorf("Expected an empty history, got %d events of %d bytes", len(db.history), db.historyBytes)
+	}
+}
@@ -0,0 +1,251 @@
+// Package dbclient is a client of the HTTP API of the db service.
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultTimeout = 3 * time.Second
+	DefaultRetries = 3
+	DefaultBackoff = 100 * time.Millisecond
+	maxBackoff     = 5 * time.Second
+	maxIdleConns   = 64
+	// maxErrorBody limits how much of an error response is kept in a
+	// StatusError.
+	maxErrorBody = 1 << 10
+)
+
+var (
+	ErrNotFound = errors.New("key not found")
+	ErrTooLarge = errors.New("key or value is too large")
+)
+
+// StatusError is returned for responses with an unexpected status code.
+type StatusError struct {
+	StatusCode int
+	// Code tells errors with the same status apart, such as "read_only" and
+	// "replica" for 503. It is empty if the server did not send one.
+	Code    string
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("db responded with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("db responded with status %d: %s", e.StatusCode, e.Message)
+}
+
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type reqBody struct {
+	Value string `json:"value"`
+}
+
+type respBody struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Client talks to one db service. It is safe for concurrent use and keeps a
+// pool of connections to the service.
+type Client struct {
+	baseURL   string
+	namespace string
+	http      *http.Client
+	retries   int
+	backoff   time.Duration
+}
+
+// Option configures optional behaviour of a Client created by New.
+type Option func(c *Client)
+
+// WithTimeout limits the duration of every attempt of a request.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.http.Timeout = timeout
+	}
+}
+
+// WithRetries sets how many times a failed request is retried. The delay
+// before a retry starts at backoff and doubles after every attempt.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.backoff = backoff
+	}
+}
+
+// WithHTTPClient replaces the HTTP client, for example to use a custom
+// transport.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.http = client
+	}
+}
+
+// WithNamespace makes the client use the keys of a namespace instead of the
+// default one. The namespace is created by the first write to it.
+func WithNamespace(namespace string) Option {
+	return func(c *Client) {
+		c.namespace = namespace
+	}
+}
+
+// New creates a client of the db service at baseURL, such as
+// http://db:8083.
+func New(baseURL string, opts ...Option) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConns
+	c := &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http:    &http.Client{Transport: transport, Timeout: DefaultTimeout},
+		retries: DefaultRetries,
+		backoff: DefaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *Client) Get(key string) (string, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext returns the value of key, or ErrNotFound if there is none.
+func (c *Client) GetContext(ctx context.Context, key string) (string, error) {
+	var body respBody
+	err := c.do(ctx, "GET", key, nil, func(resp *http.Response) error {
+		return json.NewDecoder(resp.Body).Decode(&body)
+	})
+	if err != nil {
+		return "", err
+	}
+	return body.Value, nil
+}
+
+func (c *Client) Put(key, value string) error {
+	return c.PutContext(context.Background(), key, value)
+}
+
+// PutContext sets the value of key.
+func (c *Client) PutContext(ctx context.Context, key, value string) error {
+	data, err := json.Marshal(reqBody{Value: value})
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, "POST", key, data, nil)
+}
+
+func (c *Client) Delete(key string) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext removes key. Deleting a missing key is not an error.
+func (c *Client) DeleteContext(ctx context.Context, key string) error {
+	return c.do(ctx, "DELETE", key, nil, nil)
+}
+
+// do sends a request, retrying it after network errors and responses telling
+// that the service is temporarily unavailable. All operations of the API are
+// idempotent, so retrying them is safe. read is called for a successful
+// response.
+func (c *Client) do(ctx context.Context, method, key string, body []byte, read func(*http.Response) error) error {
+	u := c.baseURL + "/db/" + url.PathEscape(key)
+	if c.namespace != "" {
+		u = c.baseURL + "/db/" + url.PathEscape(c.namespace) + "/" + url.PathEscape(key)
+	}
+	delay := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, method, u, body, read)
+		if err == nil || attempt >= c.retries || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		// Full jitter spreads the retries of many clients over time.
+		wait := time.Duration(rand.Int63n(int64(delay) + 1))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if delay *= 2; delay > maxBackoff {
+			delay = maxBackoff
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, u string, body []byte, read func(*http.Response) error) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode == http.StatusRequestEntityTooLarge:
+		return ErrTooLarge
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return readStatusError(resp)
+	}
+	if read != nil {
+		return read(resp)
+	}
+	// Drain the body, so the connection goes back to the pool.
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// readStatusError reads the JSON error of a response. The body of a server
+// not sending JSON errors is kept as the message.
+func readStatusError(resp *http.Response) *StatusError {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	var body errorBody
+	if json.Unmarshal(data, &body) == nil && body.Code != "" {
+		return &StatusError{StatusCode: resp.StatusCode, Code: body.Code, Message: body.Message}
+	}
+	return &StatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+}
+
+func retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
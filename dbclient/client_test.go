@@ -0,0 +1,103 @@
+package dbclient
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDb serves the db API from a map. The first failures requests are
+// answered with 503.
+type fakeDb struct {
+	mutex    sync.Mutex
+	values   map[string]string
+	failures int
+	requests int
+}
+
+func (f *fakeDb) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.requests++
+	if f.failures > 0 {
+		f.failures--
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(rw).Encode(errorBody{Code: "read_only", Message: "database is in read-only mode"})
+		return
+	}
+	key := strings.TrimPrefix(req.URL.Path, "/db/")
+	switch req.Method {
+	case "GET":
+		value, ok := f.values[key]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(respBody{Key: key, Value: value})
+	case "POST":
+		var body reqBody
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.values[key] = body.Value
+		rw.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		delete(f.values, key)
+	}
+}
+
+func TestClient(t *testing.T) {
+	db := &fakeDb{values: make(map[string]string)}
+	server := httptest.NewServer(db)
+	defer server.Close()
+	client := New(server.URL, WithRetries(3, time.Millisecond))
+
+	assert.NoError(t, client.Put("key with spaces", "value"))
+	value, err := client.Get("key with spaces")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+
+	assert.NoError(t, client.Delete("key with spaces"))
+	_, err = client.Get("key with spaces")
+	assert.Equal(t, ErrNotFound, err)
+
+	t.Run("namespace", func(t *testing.T) {
+		assert.NoError(t, New(server.URL, WithNamespace("users")).Put("a/b", "value"))
+		assert.Equal(t, "value", db.values["users/a/b"])
+	})
+
+	t.Run("retry unavailable service", func(t *testing.T) {
+		db.failures, db.requests = 2, 0
+		assert.NoError(t, client.Put("key", "value"))
+		assert.Equal(t, 3, db.requests)
+
+		db.failures, db.requests = 10, 0
+		err := client.Put("key", "value")
+		var statusErr *StatusError
+		if assert.True(t, errors.As(err, &statusErr)) {
+			assert.Equal(t, http.StatusServiceUnavailable, statusErr.StatusCode)
+			assert.Equal(t, "read_only", statusErr.Code)
+			assert.Equal(t, "database is in read-only mode", statusErr.Message)
+		}
+		assert.Equal(t, 4, db.requests)
+		db.failures = 0
+	})
+
+	t.Run("time out", func(t *testing.T) {
+		slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+		}))
+		defer slow.Close()
+		client := New(slow.URL, WithTimeout(10*time.Millisecond), WithRetries(0, 0))
+		_, err := client.Get("key")
+		assert.Error(t, err)
+	})
+}
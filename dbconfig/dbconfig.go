@@ -0,0 +1,199 @@
+// Package dbconfig opens the store of a data directory with the settings
+// given on the command line. cmd/db and cmd/dbtool share it, so a directory
+// written by one can be opened by the other with the same flags.
+package dbconfig
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore/sharded"
+)
+
+// confEncryptionKeys is the environment variable with the encryption keys,
+// used when no key file is given.
+const confEncryptionKeys = "DB_ENCRYPTION_KEYS"
+
+const (
+	// DefaultNamespace is the namespace stored in the data directory itself.
+	DefaultNamespace = "default"
+	// NamespacesDir is the subdirectory of the data directory holding a
+	// directory for every namespace but the default one.
+	NamespacesDir = "namespaces"
+)
+
+// NamespacePattern matches the names of namespaces. They never start with
+// '_', so they cannot be confused with the endpoints under /db/ of cmd/db.
+var NamespacePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+var codecs = map[string]datastore.Codec{
+	"none":  datastore.CodecNone,
+	"flate": datastore.CodecFlate,
+	"gzip":  datastore.CodecGzip,
+}
+
+// Store is a single datastore.Db or a sharded.Db.
+type Store interface {
+	GetContext(ctx context.Context, key string) (string, error)
+	GetRecordContext(ctx context.Context, key string) (*datastore.Record, error)
+	PutContext(ctx context.Context, key, value string) error
+	DeleteContext(ctx context.Context, key string) error
+	GetMany(ctx context.Context, keys []string) (map[string]string, error)
+	PutMany(ctx context.Context, entries []*datastore.Entry) error
+	Keys() ([]string, error)
+	Watch(prefix string) (<-chan datastore.Event, func())
+	WatchFrom(prefix string, seq uint64) (<-chan datastore.Event, func(), error)
+	LastSeq() uint64
+	Stats() datastore.Stats
+	Degraded() error
+	Close() error
+}
+
+var (
+	_ Store = (*datastore.Db)(nil)
+	_ Store = (*sharded.Db)(nil)
+)
+
+// Config holds the settings a store is opened with.
+type Config struct {
+	Shards int
+	// ShardDirs is a comma-separated list of the directories of the shards,
+	// one per shard. When empty, the shards are kept in the data directory.
+	ShardDirs            string
+	SegmentSize          int64
+	Compression          string
+	CompressionThreshold int
+	MaxKeySize           int
+	MaxValueSize         int
+	EncryptionKeyFile    string
+}
+
+// RegisterFlags defines the flags of the settings in fs.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&c.Shards, "shards", 1, "number of shards to spread the keys over")
+	fs.StringVar(&c.ShardDirs, "shard-dirs", "", "comma-separated directories of the shards, one per shard, for example on different disks; defaults to subdirectories of the data directory")
+	fs.Int64Var(&c.SegmentSize, "segment-size", 10<<20, "maximum segment file size in bytes")
+	fs.StringVar(&c.Compression, "compression", "none", "value compression codec: none, flate or gzip")
+	fs.IntVar(&c.CompressionThreshold, "compression-threshold", 1024, "minimum value size in bytes to compress")
+	fs.IntVar(&c.MaxKeySize, "max-key-size", datastore.DefaultMaxKeySize, "maximum key size in bytes")
+	fs.IntVar(&c.MaxValueSize, "max-value-size", datastore.DefaultMaxValueSize, "maximum value size in bytes")
+	fs.StringVar(&c.EncryptionKeyFile, "encryption-key-file", "", "file with encryption keys as <id>:<hex key> lines, the last one is current; defaults to "+confEncryptionKeys)
+}
+
+// Options returns the options of the datastore. Encryption keys are read from
+// the key file or, if no file is given, from the DB_ENCRYPTION_KEYS
+// environment variable.
+func (c *Config) Options() ([]datastore.Option, error) {
+	codec, ok := codecs[c.Compression]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression codec: %s", c.Compression)
+	}
+	opts := []datastore.Option{
+		datastore.WithCompression(codec, c.CompressionThreshold),
+		datastore.WithMaxKeySize(c.MaxKeySize),
+		datastore.WithMaxValueSize(c.MaxValueSize),
+	}
+	keys, err := c.loadKeyring()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load encryption keys: %w", err)
+	}
+	if keys != nil {
+		opts = append(opts, datastore.WithEncryption(keys))
+	}
+	return opts, nil
+}
+
+// loadKeyring returns nil when encryption is not configured.
+func (c *Config) loadKeyring() (*datastore.Keyring, error) {
+	if c.EncryptionKeyFile != "" {
+		f, err := os.Open(c.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return datastore.ReadKeyring(f)
+	}
+	if keys, ok := os.LookupEnv(confEncryptionKeys); ok {
+		return datastore.ReadKeyring(strings.NewReader(keys))
+	}
+	return nil, nil
+}
+
+// Open opens the store in dir with opts, as returned by Options, creating the
+// directory if needed.
+func (c *Config) Open(dir string, opts ...datastore.Option) (Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	shardDirs, err := c.shardDirs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if shardDirs != nil {
+		return sharded.NewDb(dir, shardDirs, c.SegmentSize, opts...)
+	}
+	return datastore.NewDb(dir, c.SegmentSize, opts...)
+}
+
+// shardDirs returns the directories of the shards of a store in dir, or nil
+// if the store is not sharded.
+func (c *Config) shardDirs(dir string) ([]string, error) {
+	if c.ShardDirs == "" {
+		if c.Shards > 1 {
+			return sharded.ShardDirs(dir, c.Shards), nil
+		}
+		return nil, nil
+	}
+	dirs := strings.Split(c.ShardDirs, ",")
+	for i, shardDir := range dirs {
+		if dirs[i] = strings.TrimSpace(shardDir); dirs[i] == "" {
+			return nil, fmt.Errorf("empty shard directory in %q", c.ShardDirs)
+		}
+	}
+	if c.Shards > 1 && c.Shards != len(dirs) {
+		return nil, fmt.Errorf("%d shards cannot be kept in %d shard directories", c.Shards, len(dirs))
+	}
+	return dirs, nil
+}
+
+// Nested returns the settings of a store nested in the data directory, such as
+// a namespace. Its shards, if any, are kept in its own directory rather than
+// in the shard directories of the data directory.
+func (c *Config) Nested() *Config {
+	nested := *c
+	if nested.ShardDirs != "" {
+		nested.Shards = len(strings.Split(nested.ShardDirs, ","))
+		nested.ShardDirs = ""
+	}
+	return &nested
+}
+
+// NamespaceDir returns the directory of a namespace of the data directory dir.
+func NamespaceDir(dir, namespace string) (string, error) {
+	if namespace == DefaultNamespace {
+		return dir, nil
+	}
+	if !NamespacePattern.MatchString(namespace) {
+		return "", fmt.Errorf("invalid namespace name %q", namespace)
+	}
+	return filepath.Join(dir, NamespacesDir, namespace), nil
+}
+
+// OpenNamespace opens the store of a namespace of the data directory dir the
+// way cmd/db does, creating it if needed.
+func (c *Config) OpenNamespace(dir, namespace string, opts ...datastore.Option) (Store, error) {
+	nsDir, err := NamespaceDir(dir, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if namespace == DefaultNamespace {
+		return c.Open(dir, opts...)
+	}
+	return c.Nested().Open(nsDir, opts...)
+}
@@ -0,0 +1,123 @@
+package dbconfig
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore/sharded"
+	"github.com/stretchr/testify/assert"
+)
+
+func parseConfig(t *testing.T, args ...string) *Config {
+	t.Helper()
+	var c Config
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c.RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return &c
+}
+
+func TestConfig_Options(t *testing.T) {
+	_, err := parseConfig(t, "-compression", "zstd").Options()
+	assert.ErrorContains(t, err, "unknown compression codec")
+
+	_, err = parseConfig(t, "-encryption-key-file", filepath.Join(t.TempDir(), "missing")).Options()
+	assert.ErrorContains(t, err, "failed to load encryption keys")
+
+	t.Setenv(confEncryptionKeys, "1:000102030405060708090a0b0c0d0e0f")
+	opts, err := parseConfig(t).Options()
+	assert.NoError(t, err)
+	assert.Len(t, opts, 4, "keys are read from the environment without a key file")
+}
+
+func TestConfig_Open(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	c := parseConfig(t, "-compression", "gzip", "-compression-threshold", "1")
+	opts, err := c.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := c.Open(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.IsType(t, &datastore.Db{}, store)
+	assert.NoError(t, store.PutContext(context.Background(), "key", "value value value"))
+	assert.NoError(t, store.Close())
+
+	// Records carry their codec, so a store written with compression opens
+	// with the default settings.
+	store, err = parseConfig(t).Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := store.GetContext(context.Background(), "key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value value value", value)
+	assert.NoError(t, store.Close())
+
+	shardedDir := filepath.Join(t.TempDir(), "sharded")
+	store, err = parseConfig(t, "-shards", "2").Open(shardedDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.IsType(t, &sharded.Db{}, store)
+	assert.NoError(t, store.Close())
+	_, err = os.Stat(shardedDir)
+	assert.NoError(t, err)
+
+	shardDirs := []string{filepath.Join(t.TempDir(), "disk-0"), filepath.Join(t.TempDir(), "disk-1")}
+	c = parseConfig(t, "-shard-dirs", strings.Join(shardDirs, ","))
+	store, err = c.Open(shardedDir)
+	assert.ErrorContains(t, err, "cannot open it with 2", "the store was created with other shard directories")
+	dataDir := filepath.Join(t.TempDir(), "data")
+	store, err = c.Open(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, store.Close())
+	for _, shardDir := range shardDirs {
+		assert.DirExists(t, shardDir)
+	}
+
+	nested := c.Nested()
+	assert.Equal(t, 2, nested.Shards)
+	store, err = nested.Open(filepath.Join(dataDir, "nested"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, store.Close())
+	assert.DirExists(t, sharded.ShardDir(filepath.Join(dataDir, "nested"), 1))
+
+	_, err = parseConfig(t, "-shards", "3", "-shard-dirs", "a,b").Open(t.TempDir())
+	assert.ErrorContains(t, err, "3 shards cannot be kept in 2 shard directories")
+	_, err = parseConfig(t, "-shard-dirs", "a,,b").Open(t.TempDir())
+	assert.ErrorContains(t, err, "empty shard directory")
+}
+
+func TestConfig_OpenNamespace(t *testing.T) {
+	dir := t.TempDir()
+	c := parseConfig(t, "-shards", "2")
+	store, err := c.OpenNamespace(dir, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.IsType(t, &sharded.Db{}, store)
+	assert.NoError(t, store.Close())
+	assert.DirExists(t, sharded.ShardDir(filepath.Join(dir, NamespacesDir, "users"), 1))
+
+	nsDir, err := NamespaceDir(dir, DefaultNamespace)
+	assert.NoError(t, err)
+	assert.Equal(t, dir, nsDir)
+	for _, name := range []string{"", "_users", "../users", ".dropped-users"} {
+		_, err := c.OpenNamespace(dir, name)
+		assert.ErrorContains(t, err, "invalid namespace name", name)
+	}
+}
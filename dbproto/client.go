@@ -0,0 +1,213 @@
+package dbproto
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var ErrClientClosed = errors.New("client is closed")
+
+// Client sends requests over a single connection. It is safe for concurrent
+// use: requests of concurrent callers are pipelined and matched with their
+// responses by id.
+type Client struct {
+	conn         net.Conn
+	maxFrameSize int
+
+	writeMutex sync.Mutex
+	w          *bufio.Writer
+
+	mutex   sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan frame
+	err     error
+	done    chan struct{}
+}
+
+// Dial connects to the binary port of a db service.
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, DefaultMaxFrameSize), nil
+}
+
+// NewClient creates a client using an established connection.
+func NewClient(conn net.Conn, maxFrameSize int) *Client {
+	c := &Client{
+		conn:         conn,
+		maxFrameSize: maxFrameSize,
+		w:            bufio.NewWriter(conn),
+		pending:      make(map[uint32]chan frame),
+		done:         make(chan struct{}),
+	}
+	go c.readResponses()
+	return c
+}
+
+// Close closes the connection. Requests waiting for responses fail.
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+func (c *Client) readResponses() {
+	defer close(c.done)
+	r := bufio.NewReader(c.conn)
+	for {
+		resp, err := readFrame(r, c.maxFrameSize)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.mutex.Lock()
+		ch, ok := c.pending[resp.id]
+		delete(c.pending, resp.id)
+		c.mutex.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+// fail makes all waiting and future requests return err.
+func (c *Client) fail(err error) {
+	if errors.Is(err, net.ErrClosed) {
+		err = ErrClientClosed
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+	for id, ch := range c.pending {
+		delete(c.pending, id)
+		close(ch)
+	}
+}
+
+func (c *Client) roundTrip(ctx context.Context, code Opcode, payload []byte) (frame, error) {
+	ch := make(chan frame, 1)
+	c.mutex.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mutex.Unlock()
+		return frame{}, err
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.mutex.Unlock()
+
+	c.writeMutex.Lock()
+	err := writeFrame(c.w, frame{code: byte(code), id: id, payload: payload})
+	if err == nil {
+		err = c.w.Flush()
+	}
+	c.writeMutex.Unlock()
+	if err != nil {
+		c.conn.Close()
+		return frame{}, err
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			return frame{}, c.err
+		}
+		return resp, nil
+	case <-ctx.Done():
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		return frame{}, ctx.Err()
+	}
+}
+
+func (c *Client) do(ctx context.Context, op Op) (string, error) {
+	payload, err := encodeOp(op)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.roundTrip(ctx, op.Opcode, payload)
+	if err != nil {
+		return "", err
+	}
+	if err := statusError(Status(resp.code), resp.payload); err != nil {
+		return "", err
+	}
+	return string(resp.payload), nil
+}
+
+func (c *Client) Get(key string) (string, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext returns the value of key, or ErrNotFound if there is none.
+func (c *Client) GetContext(ctx context.Context, key string) (string, error) {
+	return c.do(ctx, Op{Opcode: OpGet, Key: key})
+}
+
+func (c *Client) Put(key, value string) error {
+	return c.PutContext(context.Background(), key, value)
+}
+
+func (c *Client) PutContext(ctx context.Context, key, value string) error {
+	_, err := c.do(ctx, Op{Opcode: OpPut, Key: key, Value: value})
+	return err
+}
+
+func (c *Client) Delete(key string) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+func (c *Client) DeleteContext(ctx context.Context, key string) error {
+	_, err := c.do(ctx, Op{Opcode: OpDel, Key: key})
+	return err
+}
+
+// Batch executes the operations in order with a single request. The error
+// is only set when the whole batch failed; the outcome of every operation is
+// in its Result.
+func (c *Client) Batch(ctx context.Context, ops []Op) ([]Result, error) {
+	payload := binary.LittleEndian.AppendUint32(nil, uint32(len(ops)))
+	for _, op := range ops {
+		part, err := encodeOp(op)
+		if err != nil {
+			return nil, err
+		}
+		payload = appendPart(payload, byte(op.Opcode), part)
+	}
+	resp, err := c.roundTrip(ctx, OpBatch, payload)
+	if err != nil {
+		return nil, err
+	}
+	if err := statusError(Status(resp.code), resp.payload); err != nil {
+		return nil, err
+	}
+	codes, parts, err := splitParts(resp.payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) != len(ops) {
+		return nil, fmt.Errorf("%w: %d results for %d operations", errMalformed, len(parts), len(ops))
+	}
+	results := make([]Result, len(parts))
+	for i, part := range parts {
+		if err := statusError(Status(codes[i]), part); err != nil {
+			results[i].Err = err
+		} else {
+			results[i].Value = string(part)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,148 @@
+package dbproto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+type mapStore struct {
+	mutex  sync.Mutex
+	values map[string]string
+}
+
+func (m *mapStore) GetContext(_ context.Context, key string) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	value, ok := m.values[key]
+	if !ok {
+		return "", datastore.ErrNotFound
+	}
+	return value, nil
+}
+
+func (m *mapStore) PutContext(_ context.Context, key, value string) error {
+	if len(key) > 16 {
+		return datastore.ErrKeyTooLarge
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.values[key] = value
+	return nil
+}
+
+func (m *mapStore) DeleteContext(_ context.Context, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.values, key)
+	return nil
+}
+
+func startServer(t *testing.T) *Client {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(&mapStore{values: make(map[string]string)}, 1<<10)
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	client, err := Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestClient(t *testing.T) {
+	client := startServer(t)
+
+	assert.NoError(t, client.Put("key", "value"))
+	value, err := client.Get("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+	assert.NoError(t, client.Delete("key"))
+	_, err = client.Get("key")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, ErrTooLarge, client.Put("a-very-long-key-indeed", "value"))
+	for _, err := range []error{client.Put("", "value"), client.Delete("")} {
+		var serverErr *ServerError
+		if assert.ErrorAs(t, err, &serverErr) {
+			assert.Equal(t, errEmptyKey.Error(), serverErr.Message)
+		}
+	}
+	_, err = client.Get("")
+	assert.IsType(t, &ServerError{}, err, "an empty key is an error, not a missing key")
+
+	t.Run("pipeline concurrent requests", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				key := fmt.Sprintf("key-%d", i)
+				assert.NoError(t, client.Put(key, key))
+				value, err := client.Get(key)
+				assert.NoError(t, err)
+				assert.Equal(t, key, value)
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		results, err := client.Batch(context.Background(), []Op{
+			{Opcode: OpPut, Key: "batch", Value: "value"},
+			{Opcode: OpGet, Key: "batch"},
+			{Opcode: OpDel, Key: "batch"},
+			{Opcode: OpGet, Key: "batch"},
+		})
+		if assert.NoError(t, err) && assert.Len(t, results, 4) {
+			assert.NoError(t, results[0].Err)
+			assert.Equal(t, "value", results[1].Value)
+			assert.NoError(t, results[2].Err)
+			assert.Equal(t, ErrNotFound, results[3].Err)
+		}
+	})
+
+	t.Run("oversized frame closes the connection", func(t *testing.T) {
+		err := client.Put("key", string(make([]byte, 2<<10)))
+		assert.Error(t, err)
+		_, err = client.Get("key")
+		assert.Error(t, err)
+	})
+}
+
+func TestSplitParts_Malformed(t *testing.T) {
+	for _, payload := range [][]byte{
+		nil,
+		{1, 0, 0, 0},
+		{1, 0, 0, 0, byte(OpGet), 9, 0, 0, 0, 'k'},
+		{0xff, 0xff, 0xff, 0xff, byte(OpGet)},
+	} {
+		_, _, err := splitParts(payload)
+		assert.True(t, errors.Is(err, errMalformed), "payload %v", payload)
+	}
+}
+
+func TestPutPayload(t *testing.T) {
+	payload, err := encodeOp(Op{Opcode: OpPut, Key: "key", Value: "value"})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("\x03\x00\x00\x00keyvalue"), payload)
+	op, err := decodeOp(OpPut, payload)
+	assert.NoError(t, err)
+	assert.Equal(t, Op{Opcode: OpPut, Key: "key", Value: "value"}, op)
+
+	for _, payload := range []string{"", "\x03\x00\x00", "\x04\x00\x00\x00key", "\xff\xff\xff\xffkey"} {
+		_, err := decodeOp(OpPut, []byte(payload))
+		assert.ErrorIs(t, err, errMalformed, "%q", payload)
+	}
+}
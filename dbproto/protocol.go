@@ -0,0 +1,226 @@
+// Package dbproto implements a compact binary protocol of the db service and
+// its client.
+//
+// Every message is a frame:
+//
+//	length (4) | opcode or status (1) | request id (4) | payload
+//
+// where the length counts the bytes after itself. Clients may send many
+// requests without waiting for the responses; a response carries the id of
+// its request. Payloads of the requests are:
+//
+//	GET, DEL: the key
+//	PUT:      key length (4) | key | value
+//	BATCH:    count (4), then count times: opcode (1) | length (4) | payload
+//
+// A successful GET response carries the value, a BATCH response carries
+// count (4), then count times: status (1) | length (4) | payload. Failed
+// requests respond with the error message as the payload.
+//
+// The payloads do not depend on how the datastore lays out its records, so
+// changes of the on-disk format do not change the protocol.
+package dbproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+)
+
+// Opcode is the operation of a request.
+type Opcode byte
+
+const (
+	OpGet Opcode = iota + 1
+	OpPut
+	OpDel
+	OpBatch
+)
+
+// Status is the outcome of a request.
+type Status byte
+
+const (
+	StatusOK Status = iota
+	StatusNotFound
+	StatusTooLarge
+	StatusUnavailable
+	StatusError
+)
+
+const (
+	frameHeaderSize = 4 + 1 + 4
+	// DefaultMaxFrameSize limits frames read by the server and the client.
+	DefaultMaxFrameSize = 2*datastore.DefaultMaxValueSize + 1<<10
+)
+
+var (
+	ErrNotFound    = errors.New("key not found")
+	ErrTooLarge    = errors.New("key or value is too large")
+	ErrUnavailable = errors.New("db is unavailable")
+	ErrFrameSize   = errors.New("frame is too large")
+	errMalformed   = errors.New("malformed frame")
+	errEmptyKey    = errors.New("key is empty")
+)
+
+// ServerError is returned for requests failed by the server for a reason
+// without a dedicated status.
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "db error: " + e.Message
+}
+
+type frame struct {
+	code    byte
+	id      uint32
+	payload []byte
+}
+
+func writeFrame(w io.Writer, f frame) error {
+	var header [frameHeaderSize]byte
+	binary.LittleEndian.PutUint32(header[0:], uint32(1+4+len(f.payload)))
+	header[4] = f.code
+	binary.LittleEndian.PutUint32(header[5:], f.id)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(f.payload)
+	return err
+}
+
+func readFrame(r io.Reader, maxSize int) (frame, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return frame{}, err
+	}
+	length := int64(binary.LittleEndian.Uint32(header[0:]))
+	if length < 1+4 {
+		return frame{}, errMalformed
+	}
+	if length-1-4 > int64(maxSize) {
+		return frame{}, ErrFrameSize
+	}
+	f := frame{code: header[4], id: binary.LittleEndian.Uint32(header[5:])}
+	f.payload = make([]byte, length-1-4)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return frame{}, err
+	}
+	return f, nil
+}
+
+// Op is one operation of a batch.
+type Op struct {
+	Opcode Opcode
+	Key    string
+	Value  string
+}
+
+// Result is the outcome of one operation of a batch. Err is nil on success
+// and holds the same errors the single operations return otherwise.
+type Result struct {
+	Value string
+	Err   error
+}
+
+func encodeOp(op Op) ([]byte, error) {
+	switch op.Opcode {
+	case OpGet, OpDel:
+		return []byte(op.Key), nil
+	case OpPut:
+		buf := make([]byte, 0, 4+len(op.Key)+len(op.Value))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(op.Key)))
+		buf = append(buf, op.Key...)
+		return append(buf, op.Value...), nil
+	}
+	return nil, fmt.Errorf("unsupported opcode %d", op.Opcode)
+}
+
+func decodeOp(code Opcode, payload []byte) (Op, error) {
+	op := Op{Opcode: code}
+	switch code {
+	case OpGet, OpDel:
+		op.Key = string(payload)
+	case OpPut:
+		if len(payload) < 4 {
+			return Op{}, errMalformed
+		}
+		kl := binary.LittleEndian.Uint32(payload)
+		if uint64(kl) > uint64(len(payload)-4) {
+			return Op{}, errMalformed
+		}
+		op.Key, op.Value = string(payload[4:4+kl]), string(payload[4+kl:])
+	default:
+		return Op{}, fmt.Errorf("unsupported opcode %d", code)
+	}
+	// Empty keys are rejected as over HTTP.
+	if op.Key == "" {
+		return Op{}, errEmptyKey
+	}
+	return op, nil
+}
+
+// appendPart appends a code and a length-prefixed payload, the element of
+// batch requests and responses.
+func appendPart(buf []byte, code byte, payload []byte) []byte {
+	buf = append(buf, code)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+// splitParts parses the count-prefixed list of parts of a batch.
+func splitParts(payload []byte) (codes []byte, parts [][]byte, err error) {
+	if len(payload) < 4 {
+		return nil, nil, errMalformed
+	}
+	count := binary.LittleEndian.Uint32(payload)
+	payload = payload[4:]
+	// Every part takes at least 5 bytes, which bounds the allocation.
+	if uint64(count)*5 > uint64(len(payload)) {
+		return nil, nil, errMalformed
+	}
+	codes = make([]byte, 0, count)
+	parts = make([][]byte, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(payload) < 5 {
+			return nil, nil, errMalformed
+		}
+		code := payload[0]
+		length := binary.LittleEndian.Uint32(payload[1:])
+		payload = payload[5:]
+		if uint64(length) > uint64(len(payload)) {
+			return nil, nil, errMalformed
+		}
+		codes = append(codes, code)
+		parts = append(parts, payload[:length])
+		payload = payload[length:]
+	}
+	if len(payload) != 0 {
+		return nil, nil, errMalformed
+	}
+	return codes, parts, nil
+}
+
+// statusError converts a response status into the error returned by the
+// client.
+func statusError(status Status, payload []byte) error {
+	switch status {
+	case StatusOK:
+		return nil
+	case StatusNotFound:
+		return ErrNotFound
+	case StatusTooLarge:
+		return ErrTooLarge
+	case StatusUnavailable:
+		return fmt.Errorf("%w: %s", ErrUnavailable, payload)
+	}
+	return &ServerError{Message: string(payload)}
+}
@@ -0,0 +1,186 @@
+package dbproto
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+)
+
+// Store is the storage the server gives access to.
+type Store interface {
+	GetContext(ctx context.Context, key string) (string, error)
+	PutContext(ctx context.Context, key, value string) error
+	DeleteContext(ctx context.Context, key string) error
+}
+
+// Server answers binary protocol requests with a Store. Requests of one
+// connection are executed in order, so pipelined writes of a key are applied
+// in the order they were sent.
+type Server struct {
+	store        Store
+	maxFrameSize int
+
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func NewServer(store Store, maxFrameSize int) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		store:        store,
+		maxFrameSize: maxFrameSize,
+		conns:        make(map[net.Conn]struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+	}
+}
+
+// Serve accepts connections on l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.mutex.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mutex.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections, cancels the running requests and waits
+// for the connections to finish.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.cancel()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		req, err := readFrame(r, s.maxFrameSize)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Closing binary connection from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if err := writeFrame(w, s.handle(req)); err != nil {
+			return
+		}
+		// Responses to pipelined requests are sent together once the client
+		// has nothing more queued.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) handle(req frame) frame {
+	if Opcode(req.code) == OpBatch {
+		return s.handleBatch(req)
+	}
+	status, payload := s.execute(Opcode(req.code), req.payload)
+	return frame{code: byte(status), id: req.id, payload: payload}
+}
+
+func (s *Server) handleBatch(req frame) frame {
+	codes, parts, err := splitParts(req.payload)
+	if err != nil {
+		return frame{code: byte(StatusError), id: req.id, payload: []byte(err.Error())}
+	}
+	payload := binary.LittleEndian.AppendUint32(nil, uint32(len(parts)))
+	for i, part := range parts {
+		status, result := s.execute(Opcode(codes[i]), part)
+		payload = appendPart(payload, byte(status), result)
+	}
+	return frame{code: byte(StatusOK), id: req.id, payload: payload}
+}
+
+func (s *Server) execute(code Opcode, payload []byte) (Status, []byte) {
+	op, err := decodeOp(code, payload)
+	if err != nil {
+		return StatusError, []byte(err.Error())
+	}
+	var value string
+	switch op.Opcode {
+	case OpGet:
+		value, err = s.store.GetContext(s.ctx, op.Key)
+	case OpPut:
+		err = s.store.PutContext(s.ctx, op.Key, op.Value)
+	case OpDel:
+		err = s.store.DeleteContext(s.ctx, op.Key)
+	}
+	if err != nil {
+		return errorStatus(err), []byte(err.Error())
+	}
+	return StatusOK, []byte(value)
+}
+
+func errorStatus(err error) Status {
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+		return StatusNotFound
+	case errors.Is(err, datastore.ErrKeyTooLarge), errors.Is(err, datastore.ErrValueTooLarge):
+		return StatusTooLarge
+	case errors.Is(err, datastore.ErrReadOnly), errors.Is(err, datastore.ErrClosed),
+		errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return StatusUnavailable
+	}
+	return StatusError
+}
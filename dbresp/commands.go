@@ -0,0 +1,324 @@
+package dbresp
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+)
+
+const defaultScanCount = 10
+
+type command struct {
+	// arity is the number of arguments including the command name, or the
+	// negated minimum number for commands with variable arguments.
+	arity int
+	run   func(s *Server, w *writer, args []string)
+}
+
+var commands = map[string]command{
+	"PING":    {-1, ping},
+	"GET":     {2, get},
+	"SET":     {-3, set},
+	"DEL":     {-2, del},
+	"EXISTS":  {-2, exists},
+	"MGET":    {-2, mget},
+	"MSET":    {-3, mset},
+	"SCAN":    {-2, scan},
+	"SELECT":  {2, selectDb},
+	"COMMAND": {-1, commandInfo},
+}
+
+// execute runs a command and writes its reply. It reports whether the client
+// asked to close the connection.
+func (s *Server) execute(w *writer, args []string) bool {
+	name := strings.ToUpper(args[0])
+	if name == "QUIT" {
+		w.simple("OK")
+		return true
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		w.error("ERR unknown command '" + args[0] + "'")
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		w.error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+		return false
+	}
+	cmd.run(s, w, args)
+	return false
+}
+
+func ping(_ *Server, w *writer, args []string) {
+	switch len(args) {
+	case 1:
+		w.simple("PONG")
+	case 2:
+		w.bulk(args[1])
+	default:
+		w.error("ERR wrong number of arguments for 'ping' command")
+	}
+}
+
+func get(s *Server, w *writer, args []string) {
+	value, err := s.store.GetContext(s.ctx, args[1])
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+		w.null()
+	case err != nil:
+		w.error(errorReply(err))
+	default:
+		w.bulk(value)
+	}
+}
+
+func set(s *Server, w *writer, args []string) {
+	for _, option := range args[3:] {
+		switch strings.ToUpper(option) {
+		case "EX", "PX", "EXAT", "PXAT", "KEEPTTL":
+			w.error("ERR expiration is not supported by this server")
+		default:
+			w.error("ERR syntax error")
+		}
+		return
+	}
+	if err := s.store.PutContext(s.ctx, args[1], args[2]); err != nil {
+		w.error(errorReply(err))
+		return
+	}
+	w.simple("OK")
+}
+
+// del removes the keys and replies with the number of keys that existed.
+func del(s *Server, w *writer, args []string) {
+	deleted := 0
+	for _, key := range args[1:] {
+		_, err := s.store.GetContext(s.ctx, key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			continue
+		}
+		if err == nil {
+			err = s.store.DeleteContext(s.ctx, key)
+		}
+		if err != nil {
+			w.error(errorReply(err))
+			return
+		}
+		deleted++
+	}
+	w.integer(deleted)
+}
+
+// exists counts the given keys that exist, counting repeated keys repeatedly
+// like redis does.
+func exists(s *Server, w *writer, args []string) {
+	found := 0
+	for _, key := range args[1:] {
+		_, err := s.store.GetContext(s.ctx, key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			w.error(errorReply(err))
+			return
+		}
+		found++
+	}
+	w.integer(found)
+}
+
+func mget(s *Server, w *writer, args []string) {
+	values := make([]*string, len(args)-1)
+	for i, key := range args[1:] {
+		value, err := s.store.GetContext(s.ctx, key)
+		if errors.Is(err, datastore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			w.error(errorReply(err))
+			return
+		}
+		values[i] = &value
+	}
+	w.array(len(values))
+	for _, value := range values {
+		if value == nil {
+			w.null()
+		} else {
+			w.bulk(*value)
+		}
+	}
+}
+
+// mset sets the keys one by one. Unlike in redis, a failure may leave the
+// first keys set.
+func mset(s *Server, w *writer, args []string) {
+	if len(args)%2 != 1 {
+		w.error("ERR wrong number of arguments for 'mset' command")
+		return
+	}
+	for i := 1; i < len(args); i += 2 {
+		if err := s.store.PutContext(s.ctx, args[i], args[i+1]); err != nil {
+			w.error(errorReply(err))
+			return
+		}
+	}
+	w.simple("OK")
+}
+
+// scan iterates over the keys in lexicographic order. A scan starting at
+// cursor 0 takes a sorted snapshot of the keys, which costs a pass over all of
+// them, and the cursors it returns point into that snapshot, so the following
+// calls only page through it. The snapshot does not see keys written after it
+// was taken. A cursor whose snapshot is gone, or a plain position as used
+// before snapshots, is served from a new snapshot.
+func scan(s *Server, w *writer, args []string) {
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		w.error("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", defaultScanCount
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			w.error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				w.error("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+
+	id, position := uint32(cursor>>32), int(uint32(cursor))
+	keys, ok := s.scans.get(id)
+	if !ok {
+		if keys, err = s.store.Keys(); err != nil {
+			w.error(errorReply(err))
+			return
+		}
+		sort.Strings(keys)
+		id = s.scans.add(keys)
+	}
+
+	var matched []string
+	next := position
+	for ; next < len(keys) && next < position+count; next++ {
+		if match(pattern, keys[next]) {
+			matched = append(matched, keys[next])
+		}
+	}
+	nextCursor := uint64(id)<<32 | uint64(next)
+	if next >= len(keys) {
+		s.scans.remove(id)
+		nextCursor = 0
+	}
+
+	w.array(2)
+	w.bulk(strconv.FormatUint(nextCursor, 10))
+	w.array(len(matched))
+	for _, key := range matched {
+		w.bulk(key)
+	}
+}
+
+func selectDb(_ *Server, w *writer, args []string) {
+	if args[1] != "0" {
+		w.error("ERR DB index is out of range")
+		return
+	}
+	w.simple("OK")
+}
+
+// commandInfo answers COMMAND, sent by redis-cli on start, with no details.
+func commandInfo(_ *Server, w *writer, _ []string) {
+	w.array(0)
+}
+
+// match reports whether s matches the glob-style pattern of redis: *, ?,
+// [abc], [^abc], [a-z] and backslash escapes. On a mismatch it only goes back
+// to the last star, which then takes one more byte, so it runs in
+// O(len(pattern)*len(s)) however many stars the pattern has.
+func match(pattern, s string) bool {
+	p, i := 0, 0
+	starP, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			p++
+			starP, starI = p, i
+			continue
+		}
+		if p < len(pattern) {
+			if ok, width := matchElem(pattern[p:], s[i]); ok {
+				p += width
+				i++
+				continue
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starI++
+		p, i = starP, starI
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchElem reports whether c matches the element the pattern starts with,
+// which is not a star, and returns the length of the element.
+func matchElem(pattern string, c byte) (bool, int) {
+	switch pattern[0] {
+	case '?':
+		return true, 1
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			// An unterminated class matches the bracket literally.
+			return c == '[', 1
+		}
+		return matchClass(pattern[1:end+1], c), end + 2
+	case '\\':
+		if len(pattern) > 1 {
+			return c == pattern[1], 2
+		}
+	}
+	return c == pattern[0], 1
+}
+
+func matchClass(class string, c byte) bool {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		class = class[1:]
+	}
+	matched := false
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			lo, hi := class[i], class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			if c >= lo && c <= hi {
+				matched = true
+			}
+			i += 2
+		} else if class[i] == c {
+			matched = true
+		}
+	}
+	return matched != negate
+}
@@ -0,0 +1,287 @@
+package dbresp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+type mapStore struct {
+	mutex  sync.Mutex
+	values map[string]string
+}
+
+func (m *mapStore) GetContext(_ context.Context, key string) (string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	value, ok := m.values[key]
+	if !ok {
+		return "", datastore.ErrNotFound
+	}
+	return value, nil
+}
+
+func (m *mapStore) PutContext(_ context.Context, key, value string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.values[key] = value
+	return nil
+}
+
+func (m *mapStore) DeleteContext(_ context.Context, key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.values, key)
+	return nil
+}
+
+func (m *mapStore) Keys() ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var keys []string
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// respClient is a minimal RESP2 client. Replies are rendered as strings:
+// simple strings and errors keep their prefix, bulk strings are quoted, nil
+// is "nil" and arrays are bracketed.
+type respClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *respClient) send(args ...string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.conn.Write([]byte(b.String()))
+}
+
+func (c *respClient) reply(t *testing.T) string {
+	t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+', '-', ':':
+		return line
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "nil"
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			t.Fatal(err)
+		}
+		return strconv.Quote(string(data[:n]))
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]string, n)
+		for i := range items {
+			items[i] = c.reply(t)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	t.Fatalf("Unexpected reply %q", line)
+	return ""
+}
+
+func (c *respClient) do(t *testing.T, args ...string) string {
+	t.Helper()
+	c.send(args...)
+	return c.reply(t)
+}
+
+func startServer(t *testing.T) *respClient {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(&mapStore{values: make(map[string]string)}, 1<<10)
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &respClient{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func TestServer(t *testing.T) {
+	c := startServer(t)
+
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"ping", "hello"}, `"hello"`},
+		{[]string{"GET", "a"}, "nil"},
+		{[]string{"SET", "a", "1"}, "+OK"},
+		{[]string{"GET", "a"}, `"1"`},
+		{[]string{"SET", "a", "2", "EX", "10"}, "-ERR expiration is not supported by this server"},
+		{[]string{"MSET", "b", "2", "c", "3"}, "+OK"},
+		{[]string{"MSET", "b"}, "-ERR wrong number of arguments for 'mset' command"},
+		{[]string{"MGET", "a", "missing", "c"}, `["1" nil "3"]`},
+		{[]string{"EXISTS", "a", "a", "missing"}, ":2"},
+		{[]string{"SCAN", "0", "COUNT", "2"}, `["4294967298" ["a" "b"]]`},
+		{[]string{"SCAN", "4294967298", "COUNT", "2"}, `["0" ["c"]]`},
+		{[]string{"SCAN", "2", "COUNT", "2"}, `["0" ["c"]]`},
+		{[]string{"SCAN", "0", "MATCH", "[ab]"}, `["0" ["a" "b"]]`},
+		{[]string{"DEL", "a", "b", "missing"}, ":2"},
+		{[]string{"EXISTS", "a", "b", "c"}, ":1"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"FLUSHALL"}, "-ERR unknown command 'FLUSHALL'"},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.expected, c.do(t, tc.args...), "%v", tc.args)
+	}
+
+	t.Run("pipeline", func(t *testing.T) {
+		c.send("SET", "p", "1")
+		c.send("GET", "p")
+		c.send("DEL", "p")
+		assert.Equal(t, "+OK", c.reply(t))
+		assert.Equal(t, `"1"`, c.reply(t))
+		assert.Equal(t, ":1", c.reply(t))
+	})
+
+	t.Run("inline command", func(t *testing.T) {
+		c.conn.Write([]byte("SET inline value\r\nGET inline\r\n"))
+		assert.Equal(t, "+OK", c.reply(t))
+		assert.Equal(t, `"value"`, c.reply(t))
+	})
+
+	t.Run("protocol error", func(t *testing.T) {
+		c.conn.Write([]byte("*1\r\n$9999\r\n"))
+		assert.Equal(t, "-ERR Protocol error: invalid bulk length", c.reply(t))
+	})
+}
+
+func TestServer_Scan(t *testing.T) {
+	c := startServer(t)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		assert.Equal(t, "+OK", c.do(t, "SET", key, "v"))
+	}
+
+	first := c.do(t, "SCAN", "0", "COUNT", "2")
+	assert.Equal(t, `["4294967298" ["a" "b"]]`, first)
+	second := c.do(t, "SCAN", "0", "COUNT", "1")
+	assert.Equal(t, `["8589934593" ["a"]]`, second)
+
+	// Keys written during a scan are not seen by it.
+	assert.Equal(t, "+OK", c.do(t, "SET", "bb", "v"))
+	assert.Equal(t, `["0" ["c" "d"]]`, c.do(t, "SCAN", "4294967298", "COUNT", "10"))
+	assert.Equal(t, `["8589934595" ["b" "c"]]`, c.do(t, "SCAN", "8589934593", "COUNT", "2"))
+
+	// A finished scan is dropped, so its cursor continues from its position
+	// in a new snapshot.
+	assert.Equal(t, `["12884901891" ["bb"]]`, c.do(t, "SCAN", "4294967298", "COUNT", "1"))
+	assert.Equal(t, "-ERR invalid cursor", c.do(t, "SCAN", "-1"))
+}
+
+func TestScans(t *testing.T) {
+	var s scans
+	first := s.add([]string{"a"})
+	for i := 0; i < maxScans; i++ {
+		s.add(nil)
+	}
+	_, ok := s.get(first)
+	assert.False(t, ok, "the least recently used snapshot is dropped")
+
+	id := s.add([]string{"b"})
+	keys, ok := s.get(id)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"b"}, keys)
+	s.snapshots[id].used = time.Now().Add(-2 * scanTTL)
+	_, ok = s.get(id)
+	assert.False(t, ok, "snapshots expire")
+}
+
+func TestServer_NegativeLengths(t *testing.T) {
+	c := startServer(t)
+
+	c.conn.Write([]byte("*-1\r\n"))
+	assert.Equal(t, "+PONG", c.do(t, "PING"))
+
+	c.conn.Write([]byte("*1\r\n$-1\r\n"))
+	assert.Equal(t, "-ERR Protocol error: invalid bulk length", c.reply(t))
+}
+
+func TestReadCommand(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected []string
+		err      string
+	}{
+		{"*2\r\n$3\r\nGET\r\n$1\r\na\r\n", []string{"GET", "a"}, ""},
+		{"*-1\r\n", nil, ""},
+		{"*0\r\n", nil, ""},
+		{"*-9223372036854775808\r\n", nil, ""},
+		{"*x\r\n", nil, "invalid multibulk length"},
+		{"*1\r\n$-1\r\n", nil, "invalid bulk length"},
+		{"*1\r\n$-5\r\n", nil, "invalid bulk length"},
+		{"*1\r\n$2000\r\n", nil, "invalid bulk length"},
+	}
+	for _, tc := range cases {
+		args, err := readCommand(bufio.NewReader(strings.NewReader(tc.input)), 1<<10)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, "%q", tc.input)
+			continue
+		}
+		assert.NoError(t, err, "%q", tc.input)
+		assert.Equal(t, tc.expected, args, "%q", tc.input)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		expected   bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"h?llo", "hello", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-f]llo", "hello", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"*:*:x", "a:b:x", true},
+		{"*:*:x", "a:b:y", false},
+		{"a*", "a", true},
+		{"*", "", true},
+		{"?", "", false},
+		{"**a", "bba", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYcZ", false},
+		{"[ab", "[ab", true},
+		{"h[]llo", "hello", false},
+		{`a\`, `a\`, true},
+		{strings.Repeat("*a", 30) + "b", strings.Repeat("a", 100), false},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.expected, match(tc.pattern, tc.s), "%s %s", tc.pattern, tc.s)
+	}
+}
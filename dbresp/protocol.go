@@ -0,0 +1,132 @@
+package dbresp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+)
+
+// maxArgs limits the number of arguments of a command.
+const maxArgs = 1 << 20
+
+// protocolError is a malformed command. The connection is closed after it is
+// reported.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return string(e)
+}
+
+// readCommand reads a command sent as an array of bulk strings, or as an
+// inline command of space-separated words.
+func readCommand(r *bufio.Reader, maxBulkSize int) ([]string, error) {
+	line, err := readLine(r, maxBulkSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return inlineArgs(line), nil
+	}
+
+	count, err := strconv.Atoi(string(line[1:]))
+	if err != nil || count > maxArgs {
+		return nil, protocolError("invalid multibulk length")
+	}
+	if count <= 0 {
+		// A null or empty array is skipped, as redis does.
+		return nil, nil
+	}
+	// The slice grows with the arguments read, as count comes from the client.
+	var args []string
+	for i := 0; i < count; i++ {
+		line, err := readLine(r, maxBulkSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, protocolError("expected '$', got '" + string(line) + "'")
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkSize {
+			return nil, protocolError("invalid bulk length")
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(data, []byte("\r\n")) {
+			return nil, protocolError("bulk string is not terminated")
+		}
+		args = append(args, string(data[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads a line terminated by CRLF, or by LF as redis does for
+// inline commands.
+func readLine(r *bufio.Reader, maxSize int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxSize {
+			return nil, protocolError("too big inline request")
+		}
+		if !isPrefix {
+			return line, nil
+		}
+	}
+}
+
+func inlineArgs(line []byte) []string {
+	var args []string
+	for _, field := range bytes.Fields(line) {
+		args = append(args, string(field))
+	}
+	return args
+}
+
+// writer writes RESP2 replies.
+type writer struct {
+	*bufio.Writer
+}
+
+func (w *writer) simple(s string) {
+	w.WriteByte('+')
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w *writer) error(s string) {
+	w.WriteByte('-')
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w *writer) integer(n int) {
+	w.WriteByte(':')
+	w.WriteString(strconv.Itoa(n))
+	w.WriteString("\r\n")
+}
+
+func (w *writer) bulk(s string) {
+	w.WriteByte('$')
+	w.WriteString(strconv.Itoa(len(s)))
+	w.WriteString("\r\n")
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w *writer) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w *writer) array(n int) {
+	w.WriteByte('*')
+	w.WriteString(strconv.Itoa(n))
+	w.WriteString("\r\n")
+}
@@ -0,0 +1,73 @@
+package dbresp
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maxScans is the number of scan snapshots kept. Starting another scan
+	// drops the least recently used one.
+	maxScans = 64
+	// scanTTL is how long a snapshot is kept after it was last used.
+	scanTTL = time.Minute
+)
+
+type scanSnapshot struct {
+	keys []string
+	used time.Time
+}
+
+// scans holds the sorted keys of the scans in progress, identified by the
+// upper half of their cursors.
+type scans struct {
+	mutex     sync.Mutex
+	snapshots map[uint32]*scanSnapshot
+	lastID    uint32
+}
+
+func (s *scans) get(id uint32) ([]string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	snapshot, ok := s.snapshots[id]
+	if !ok || time.Since(snapshot.used) > scanTTL {
+		return nil, false
+	}
+	snapshot.used = time.Now()
+	return snapshot.keys, true
+}
+
+// add keeps the keys of a new scan and returns its id, which is never 0.
+func (s *scans) add(keys []string) uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.snapshots == nil {
+		s.snapshots = make(map[uint32]*scanSnapshot)
+	}
+	now := time.Now()
+	var oldest uint32
+	for id, snapshot := range s.snapshots {
+		if now.Sub(snapshot.used) > scanTTL {
+			delete(s.snapshots, id)
+		} else if oldest == 0 || snapshot.used.Before(s.snapshots[oldest].used) {
+			oldest = id
+		}
+	}
+	if len(s.snapshots) >= maxScans {
+		delete(s.snapshots, oldest)
+	}
+	for {
+		s.lastID++
+		if _, ok := s.snapshots[s.lastID]; !ok && s.lastID != 0 {
+			break
+		}
+	}
+	s.snapshots[s.lastID] = &scanSnapshot{keys: keys, used: now}
+	return s.lastID
+}
+
+func (s *scans) remove(id uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.snapshots, id)
+}
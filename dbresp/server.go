@@ -0,0 +1,148 @@
+// Package dbresp serves a subset of the Redis protocol (RESP2) from a
+// datastore, so Redis clients can read and write it.
+package dbresp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/datastore"
+)
+
+// Store is the storage the server gives access to.
+type Store interface {
+	GetContext(ctx context.Context, key string) (string, error)
+	PutContext(ctx context.Context, key, value string) error
+	DeleteContext(ctx context.Context, key string) error
+	Keys() ([]string, error)
+}
+
+// Server answers RESP2 commands with a Store. Commands of one connection are
+// executed in order.
+type Server struct {
+	store       Store
+	maxBulkSize int
+	scans       scans
+
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func NewServer(store Store, maxBulkSize int) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		store:       store,
+		maxBulkSize: maxBulkSize,
+		conns:       make(map[net.Conn]struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Serve accepts connections on l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.mutex.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mutex.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections, cancels the running commands and waits
+// for the connections to finish.
+func (s *Server) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.cancel()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := &writer{bufio.NewWriter(conn)}
+	for {
+		args, err := readCommand(r, s.maxBulkSize)
+		var protoErr protocolError
+		if errors.As(err, &protoErr) {
+			// The stream cannot be resynchronised after a malformed command.
+			w.error("ERR Protocol error: " + protoErr.Error())
+			w.Flush()
+			return
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Closing RESP connection from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.execute(w, args)
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// errorReply converts an error of the store into a RESP error message.
+func errorReply(err error) string {
+	if errors.Is(err, datastore.ErrReadOnly) {
+		return "READONLY " + err.Error()
+	}
+	return "ERR " + err.Error()
+}
@@ -1,6 +1,7 @@
 package httptools
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 
 type Server interface {
 	Start()
+	Shutdown(ctx context.Context) error
 }
 
 type server struct {
@@ -19,10 +21,20 @@ func (s server) Start() {
 	go func() {
 		log.Println("Staring the HTTP server...")
 		err := s.httpServer.ListenAndServe()
+		if err == http.ErrServerClosed {
+			log.Println("HTTP server stopped.")
+			return
+		}
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
+// Shutdown stops accepting new connections and waits for the active requests
+// to complete until ctx expires.
+func (s server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
 func CreateServer(port int, handler http.Handler) Server {
 	return server{
 		httpServer: &http.Server{
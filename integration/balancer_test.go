@@ -7,9 +7,14 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"github.com/NikitaSutulov/software-architecture-lab4/dbclient"
 )
 
-const baseAddress = "http://balancer:8090"
+const (
+	baseAddress = "http://balancer:8090"
+	dbAddress   = "http://db:8083"
+)
 
 var client = http.Client{
 	Timeout: 3 * time.Second,
@@ -99,6 +104,27 @@ func TestBalancer_NotFound(t *testing.T) {
 	checkResponseStatusCode(t, "wrongKEY", http.StatusNotFound)
 }
 
+func TestBalancer_DbClient(t *testing.T) {
+	if _, exists := os.LookupEnv("INTEGRATION_TEST"); !exists {
+		t.Skip("Integration test is not enabled")
+	}
+
+	db := dbclient.New(dbAddress)
+	key := fmt.Sprintf("integration-%d", time.Now().UnixNano())
+	if err := db.Put(key, "value"); err != nil {
+		t.Fatal(err)
+	}
+	checkResponseStatusCode(t, key, http.StatusOK)
+
+	if err := db.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get(key); err != dbclient.ErrNotFound {
+		t.Errorf("Expected ErrNotFound after delete, got %v", err)
+	}
+	checkResponseStatusCode(t, key, http.StatusNotFound)
+}
+
 func checkResponseStatusCode(t *testing.T, key string, expectedStatusCode int) {
 	addr := fmt.Sprintf("%s/api/v1/some-data?key=%s", baseAddress, key)
 	resp, err := client.Get(addr)